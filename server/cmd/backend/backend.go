@@ -11,14 +11,33 @@ import (
 )
 
 var listenaddr = flag.String("addr", ":8080", "WebSocket Service bind address")
+var origins = flag.String("origins", "*", "comma separated list of allowed origins, e.g. https://*.vchamber.me")
+var adminToken = flag.String("admin-token", "", "bearer token for the admin API (default $"+vserver.AdminTokenEnv+")")
+var proxies = flag.String("trusted-proxies", "", "comma separated list of reverse proxy addresses or networks whose X-Forwarded-For is trusted")
+var tokenSecret = flag.String("token-secret", "", "secret for verifying signed room tokens (default $"+vserver.TokenSecretEnv+")")
 
 func main() {
 
 	flag.Parse()
 
 	server := vserver.NewServer()
+	policy, err := vserver.NewOriginPolicy(vserver.ParseOriginList(*origins))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetOriginPolicy(policy)
+	trusted, err := vserver.NewTrustedProxies(vserver.ParseOriginList(*proxies))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetTrustedProxies(trusted)
+	server.SetTokenSigner(vserver.NewTokenSigner(vserver.TokenSecretFromEnv(*tokenSecret)))
 
-	mux := vserver.NewVChamberRestMux(server)
+	admin := vserver.NewAdminAuth(vserver.AdminTokenFromEnv(*adminToken))
+	if !admin.Enabled() {
+		log.Println("no admin token configured, admin API disabled")
+	}
+	mux := vserver.NewVChamberRestMux(server, admin)
 	mux.HandleFunc("/ws", vserver.GetVChamberWSHandleFunc(server))
 
 	go server.Run()
@@ -6,10 +6,12 @@ import (
 	"net/http"
 
 	"github.com/UoB-Cloud-Computing-2018-KLS/vchamber/schedule"
+	vserver "github.com/UoB-Cloud-Computing-2018-KLS/vchamber/server"
 )
 
 var wsaddr = flag.String("ws", ":8080", "WebSocket Service bind address")
 var redis = flag.String("redis", "redis-sentinel:26379", "Redis Sentinel address")
+var origins = flag.String("origins", "*", "comma separated list of allowed origins, e.g. https://*.vchamber.me")
 
 func main() {
 	flag.Parse()
@@ -21,5 +23,10 @@ func main() {
 	}
 
 	rp := schedule.NewLoadBalancedReverseProxy(store)
+	policy, err := vserver.NewOriginPolicy(vserver.ParseOriginList(*origins))
+	if err != nil {
+		log.Fatal(err)
+	}
+	rp.SetOriginPolicy(policy)
 	log.Fatal(http.ListenAndServe(*wsaddr, rp.GetProxy()))
 }
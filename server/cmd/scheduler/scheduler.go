@@ -6,11 +6,13 @@ import (
 	"net/http"
 
 	"github.com/UoB-Cloud-Computing-2018-KLS/vchamber/schedule"
+	vserver "github.com/UoB-Cloud-Computing-2018-KLS/vchamber/server"
 	"github.com/go-redis/redis"
 )
 
 var restaddr = flag.String("addr", ":8080", "RESTful Service bind address")
 var sentinel = flag.String("redis", "redis-sentinel:26379", "Redis Sentinel address")
+var tokenSecret = flag.String("token-secret", "", "secret for signing room tokens (default $"+vserver.TokenSecretEnv+")")
 
 func main() {
 	flag.Parse()
@@ -23,10 +25,13 @@ func main() {
 	store := schedule.NewRedisStorage(redisc)
 
 	sch := schedule.NewScheduler(redisc, store)
+	sch.SetTokenSigner(vserver.NewTokenSigner(vserver.TokenSecretFromEnv(*tokenSecret)))
 	go sch.RunScheduler()
 
 	mux := http.NewServeMux()
-	mux.Handle("/room", sch.GetProxy())
+	proxy := sch.GetProxy()
+	mux.Handle("/room", sch.CheckRoomID(proxy))
+	mux.Handle("/room/", proxy)
 	// withCORS := cors.Default().Handler(mux)
 
 	log.Fatal(http.ListenAndServe(*restaddr, mux))
@@ -23,7 +23,9 @@ require (
 	github.com/rs/cors v1.6.0
 	github.com/rs/xid v1.2.1
 	github.com/spf13/pflag v1.0.3 // indirect
-	github.com/stretchr/testify v1.3.0 // indirect
+	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	golang.org/x/arch v0.0.0-20181203225421-5a4828bb7045 // indirect
 	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc // indirect
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890 // indirect
@@ -12,7 +12,8 @@ import (
 // LoadBalancedReverseProxy is a reverse proxy that serves as an entry point
 // for multiple backend servers
 type LoadBalancedReverseProxy struct {
-	reg ReadOnlyStorage
+	reg     ReadOnlyStorage
+	origins *vsv.OriginPolicy
 }
 
 // NewLoadBalancedReverseProxy creates a new reverse proxy with the specific in-memory
@@ -42,10 +43,15 @@ func (r *LoadBalancedReverseProxy) ProxyBackend() func(*http.Request) *url.URL {
 
 }
 
+// SetOriginPolicy restricts the origins allowed to connect through the proxy
+func (r *LoadBalancedReverseProxy) SetOriginPolicy(p *vsv.OriginPolicy) {
+	r.origins = p
+}
+
 // GetProxy returns a websocket reverse proxy object with registry-backed backend
 func (r *LoadBalancedReverseProxy) GetProxy() *websocketproxy.WebsocketProxy {
 	return &websocketproxy.WebsocketProxy{
 		Backend:  r.ProxyBackend(),
-		Upgrader: vsv.GetWSUpgrader(),
+		Upgrader: vsv.GetWSUpgrader(r.origins),
 	}
 }
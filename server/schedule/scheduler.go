@@ -2,6 +2,7 @@ package schedule
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +26,15 @@ const (
 	SchedulePubSubChannel  = "schedule"
 )
 
+// the same limit as the backends put on request bodies
+const maxRequestBodySize = 1 << 16
+
+type contextKey int
+
+// reservedBackendKey is the request context key of the backend a room ID was
+// reserved on by CheckRoomID
+const reservedBackendKey contextKey = iota
+
 // url schemes for our backends
 var (
 	BackendWSScheme, _   = url.Parse("ws://example.com:8080")
@@ -38,6 +50,7 @@ type Scheduler struct {
 	pool   hostpool.HostPool
 	pubsub *redis.PubSub
 	mutex  *sync.RWMutex
+	signer *vserver.TokenSigner
 }
 
 // SchedulingStrategy enum
@@ -78,6 +91,29 @@ func NewScheduler(rclient *redis.Client, s Storage) *Scheduler {
 	}
 }
 
+// SetTokenSigner makes the scheduler sign the tokens of newly created rooms,
+// it must be called before the scheduler starts serving
+func (sch *Scheduler) SetTokenSigner(ts *vserver.TokenSigner) {
+	sch.signer = ts
+}
+
+// signRoomTokens adds signed master and guest tokens to m
+func (sch *Scheduler) signRoomTokens(m *vserver.RoomCreatedMsg) error {
+	mc := vserver.NewTokenClaims(m.RoomID, "master", vserver.DefaultSignedTokenTTL)
+	mt, err := sch.signer.Sign(mc)
+	if err != nil {
+		return err
+	}
+	gc := vserver.NewTokenClaims(m.RoomID, "guest", vserver.DefaultSignedTokenTTL)
+	gt, err := sch.signer.Sign(gc)
+	if err != nil {
+		return err
+	}
+	m.SignedMasterKey = mt
+	m.SignedGuestKey = gt
+	return nil
+}
+
 // RebuildPool recreate the backend pool base on current scheduleinfo,
 // NOT thread-safe
 func (sch *Scheduler) RebuildPool() {
@@ -119,11 +155,35 @@ func (sch *Scheduler) RunScheduler() {
 	}
 }
 
+// roomIDFromPath extracts the room ID from a /room/{rid} request path, it
+// returns an empty string for the room creation endpoint
+func roomIDFromPath(p string) string {
+	p = strings.Trim(strings.TrimPrefix(p, "/room"), "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		p = p[:i]
+	}
+	return p
+}
+
+// BackendFor returns the backend hosting the room requested by req, or a
+// freshly scheduled backend if req does not refer to an existing room
+func (sch *Scheduler) BackendFor(req *http.Request) string {
+	if h, ok := req.Context().Value(reservedBackendKey).(string); ok {
+		return h
+	}
+	if rid := roomIDFromPath(req.URL.Path); rid != "" {
+		if h, err := sch.store.Get(rid); err == nil && h != "" {
+			return h
+		}
+	}
+	return sch.NextBackend()
+}
+
 // ProxyDirector returns a Director function for the reverseproxy
 func (sch *Scheduler) ProxyDirector() func(*http.Request) {
 	return func(req *http.Request) {
 		req.URL.Scheme = BackendRESTScheme.Scheme
-		req.URL.Host = sch.NextBackend()
+		req.URL.Host = sch.BackendFor(req)
 		if _, ok := req.Header["User-Agent"]; !ok {
 			req.Header.Set("User-Agent", "")
 		}
@@ -133,28 +193,100 @@ func (sch *Scheduler) ProxyDirector() func(*http.Request) {
 // RoomRegister returns a ModifyResponse function for the reverseproxy
 func (sch *Scheduler) RoomRegister() func(*http.Response) error {
 	return func(rsp *http.Response) error {
-		if rsp.StatusCode == http.StatusOK {
-			// register the room
-			b, err := ioutil.ReadAll(rsp.Body)
-			if err != nil {
-				return err
+		if rsp.StatusCode != http.StatusOK {
+			return nil
+		}
+		rid := roomIDFromPath(rsp.Request.URL.Path)
+		if rid != "" {
+			// deregister the room once the backend has destroyed it
+			if rsp.Request.Method == http.MethodDelete &&
+				strings.Trim(rsp.Request.URL.Path, "/") == "room/"+rid {
+				if err := sch.store.Del(rid); err != nil {
+					log.Printf("failed to deregister room %s: %v", rid, err)
+				}
 			}
-			err = rsp.Body.Close()
-			if err != nil {
+			return nil
+		}
+		// register the room
+		b, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			return err
+		}
+		err = rsp.Body.Close()
+		if err != nil {
+			return err
+		}
+		var m vserver.RoomCreatedMsg
+		if err := json.Unmarshal(b, &m); err != nil {
+			return errors.New("Internal error during room creation")
+		}
+		sch.store.Set(m.RoomID, rsp.Request.URL.Host)
+		if sch.signer != nil {
+			if err := sch.signRoomTokens(&m); err != nil {
 				return err
 			}
-			var m vserver.RoomCreatedMsg
-			if err := json.Unmarshal(b, &m); err != nil {
-				return errors.New("Internal error during room creation")
+			if b, err = json.Marshal(&m); err != nil {
+				return err
 			}
-			sch.store.Set(m.RoomID, rsp.Request.URL.Host)
-			// put the original content back
-			rsp.Body = ioutil.NopCloser(bytes.NewReader(b))
+			rsp.ContentLength = int64(len(b))
+			rsp.Header.Set("Content-Length", strconv.Itoa(len(b)))
 		}
+		// put the original content back
+		rsp.Body = ioutil.NopCloser(bytes.NewReader(b))
 		return nil
 	}
 }
 
+// statusRecorder records the status code written to a http.ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// CheckRoomID wraps next to reject room creation requests asking for a room
+// ID that is already registered on any backend, the ID is reserved in the
+// registry before the request is proxied and released if creation fails
+func (sch *Scheduler) CheckRoomID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body != nil && roomIDFromPath(req.URL.Path) == "" {
+			b, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBodySize))
+			req.Body.Close()
+			if err != nil {
+				vserver.RespondWithError("Malformed room creation request.", http.StatusBadRequest, w)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+			var m vserver.CreateRoomRequest
+			if json.Unmarshal(b, &m) == nil && m.RoomID != "" {
+				h := sch.NextBackend()
+				ok, err := sch.store.SetNX(m.RoomID, h)
+				if err != nil {
+					vserver.RespondWithError("An internal error occurred.", http.StatusInternalServerError, w)
+					return
+				}
+				if !ok {
+					vserver.RespondWithError(vserver.ErrRoomIDTaken, http.StatusConflict, w)
+					return
+				}
+				rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+				next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), reservedBackendKey, h)))
+				if rec.status != http.StatusOK {
+					if err := sch.store.Del(m.RoomID); err != nil {
+						log.Printf("failed to release room ID %s: %v", m.RoomID, err)
+					}
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 // GetProxy returns the reverse proxy http.Handler
 func (sch *Scheduler) GetProxy() *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{Director: sch.ProxyDirector(), ModifyResponse: sch.RoomRegister()}
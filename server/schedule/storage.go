@@ -28,6 +28,8 @@ type Storage interface {
 	BackendType() StorageBackendType
 	Get(string) (string, error)
 	Set(string, string) error
+	// SetNX sets a key only if it does not exist and reports whether it did
+	SetNX(string, string) (bool, error)
 	Del(string) error
 }
 
@@ -50,6 +52,16 @@ func (b *memBackend) Set(k string, v string) error {
 	return nil
 }
 
+func (b *memBackend) SetNX(k string, v string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.m[k]; ok {
+		return false, nil
+	}
+	b.m[k] = v
+	return true, nil
+}
+
 func (b *memBackend) Del(k string) error {
 	b.mutex.Lock()
 	delete(b.m, k)
@@ -73,6 +85,10 @@ func (b *redisBackend) Set(k string, v string) error {
 	return b.RedisClient.Set(k, v, RedisEntryTTL).Err()
 }
 
+func (b *redisBackend) SetNX(k string, v string) (bool, error) {
+	return b.RedisClient.SetNX(k, v, RedisEntryTTL).Result()
+}
+
 func (b *redisBackend) Del(k string) error {
 	return b.RedisClient.Del(k).Err()
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminTokenEnv is the environment variable holding the admin bearer token
+const AdminTokenEnv = "VCHAMBER_ADMIN_TOKEN"
+
+const (
+	ErrAdminDisabled     = "Error: Admin API disabled"
+	ErrAdminUnauthorised = "Error: Invalid admin credentials"
+)
+
+// AdminAuth guards administrative endpoints with a static bearer token
+type AdminAuth struct {
+	token string
+}
+
+// NewAdminAuth creates an AdminAuth accepting token, an empty token disables
+// all endpoints guarded by it
+func NewAdminAuth(token string) *AdminAuth {
+	return &AdminAuth{token: token}
+}
+
+// AdminTokenFromEnv returns token if it is set, otherwise the value of AdminTokenEnv
+func AdminTokenFromEnv(token string) string {
+	if token != "" {
+		return token
+	}
+	return os.Getenv(AdminTokenEnv)
+}
+
+// Enabled reports whether an admin token is configured
+func (a *AdminAuth) Enabled() bool {
+	return a != nil && a.token != ""
+}
+
+// Check reports whether r carries the admin bearer token
+func (a *AdminAuth) Check(r *http.Request) bool {
+	if !a.Enabled() {
+		return false
+	}
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(a.token)) == 1
+}
+
+// Wrap returns a handler that only passes requests carrying the admin token to h
+func (a *AdminAuth) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			RespondWithError(ErrAdminDisabled, http.StatusForbidden, w)
+			return
+		}
+		if !a.Check(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vchamber-admin"`)
+			RespondWithError(ErrAdminUnauthorised, http.StatusUnauthorized, w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WrapFunc is the http.HandlerFunc counterpart of Wrap
+func (a *AdminAuth) WrapFunc(f http.HandlerFunc) http.HandlerFunc {
+	return a.Wrap(f).ServeHTTP
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// the maximum length of a websocket close reason
+const maxCloseReasonLength = 123
+
+func banKeyAddress(addr string) string {
+	return "addr:" + addr
+}
+
+func banKeyToken(id string) string {
+	return "token:" + id
+}
+
+// ban rejects future connections to room r from the address of c, and with
+// the token of c unless it is shared by everyone with the room link
+func (r *Room) ban(c *ClientConn) {
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	if c.addr != "" {
+		r.bans[banKeyAddress(c.addr)] = true
+	}
+	if c.token != nil && !c.token.shared() {
+		r.bans[banKeyToken(c.token.ID)] = true
+	}
+}
+
+// isBanned reports whether a client connecting from addr with the token
+// tokenID has been banned from room r
+func (r *Room) isBanned(addr string, tokenID string) bool {
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	return r.bans[banKeyAddress(addr)] || r.bans[banKeyToken(tokenID)]
+}
+
+// kick removes the client with the given ID from room r and optionally bans
+// it, it returns false if there is no such client, NOT thread-safe
+func (r *Room) kick(cid string, ban bool, reason string) bool {
+	c, ok := r.clients[cid]
+	if !ok {
+		return false
+	}
+	if ban {
+		r.ban(c)
+	}
+	msg := CloseReasonKicked
+	if reason != "" {
+		msg += ": " + reason
+	}
+	if len(msg) > maxCloseReasonLength {
+		msg = msg[:maxCloseReasonLength]
+	}
+	log.Printf("client %s kicked from room %s, banned: %v", c, r.ID, ban)
+	r.killClientWithReason(c, websocket.ClosePolicyViolation, msg)
+	return true
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	resumeMargin  = 250 * time.Millisecond // added to the latency of the slowest client
+	maxResumeLead = 2 * time.Second
+	stallRate     = 1.0 // reports of buffering starting per second allowed per client
+	stallBurst    = 5.0
+)
+
+// validBufferingFraction reports whether f is a valid fraction of clients
+// for the buffering barrier, 0 waits for any single client
+func validBufferingFraction(f float64) bool {
+	return f >= 0 && f <= 1 && !math.IsNaN(f)
+}
+
+// setBuffering records whether client c is buffering, NOT thread-safe
+func (r *Room) setBuffering(c *ClientConn, buffering bool) {
+	if c.buffering == buffering {
+		return
+	}
+	c.buffering = buffering
+	r.checkBarrier()
+}
+
+// setBufferingWait turns waiting for buffering clients on or off, NOT thread-safe
+func (r *Room) setBufferingWait(c *ClientConn, p *BufferingWaitMessage) error {
+	if !validBufferingFraction(p.Fraction) {
+		return errors.New("the buffering fraction must be between 0 and 1")
+	}
+	r.opts.WaitForBuffering = p.Enabled
+	r.opts.BufferingFraction = p.Fraction
+	log.Printf("client %s set waiting for buffering in room %s to %v", c, r.ID, p.Enabled)
+	r.checkBarrier()
+	return nil
+}
+
+// stalled reports whether enough clients are buffering to hold playback, NOT thread-safe
+func (r *Room) stalled() bool {
+	if !r.opts.WaitForBuffering {
+		return false
+	}
+	n := 0
+	for _, c := range r.clients {
+		if c.buffering {
+			n++
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	return float64(n) >= r.opts.BufferingFraction*float64(len(r.clients))
+}
+
+// resumeLead returns how far in the future playback should resume so that
+// every client gets the state in time, NOT thread-safe
+func (r *Room) resumeLead() time.Duration {
+	var slowest time.Duration
+	for _, c := range r.clients {
+		if l := c.Latency(); l > slowest {
+			slowest = l
+		}
+	}
+	lead := slowest/2 + resumeMargin
+	if lead > maxResumeLead {
+		lead = maxResumeLead
+	}
+	return lead
+}
+
+// checkBarrier pauses playback while clients are buffering and resumes it
+// at a common start time once they are ready, it returns true if it
+// broadcast a new state, NOT thread-safe
+func (r *Room) checkBarrier() bool {
+	select {
+	case <-r.closing:
+		return false
+	default:
+	}
+	st := r.state
+	if r.stalled() {
+		if st.status != PlaybackStatusPlaying {
+			return false
+		}
+		st.position = r.currentPosition()
+		st.status = PlaybackStatusPaused
+		st.lastUpdated = time.Now()
+		st.updatedBy = ""
+		st.updatedByName = ""
+		r.held = true
+		r.bumpVersion()
+		r.scheduleEnd()
+		log.Printf("room %s is waiting for buffering clients", r.ID)
+		r.BroadcastState()
+		return true
+	}
+	if !r.held {
+		return false
+	}
+	r.held = false
+	if st.status != PlaybackStatusPaused {
+		return false
+	}
+	st.status = PlaybackStatusPlaying
+	st.lastUpdated = time.Now().Add(r.resumeLead())
+	r.bumpVersion()
+	r.scheduleEnd()
+	log.Printf("room %s resumes after buffering", r.ID)
+	r.BroadcastState()
+	return true
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	chatHistorySize = 50
+	maxChatLength   = 500 // in runes
+	chatRate        = 1.0 // chat messages per second allowed per client
+	chatBurst       = 5.0
+)
+
+// chatRing is a bounded buffer of the most recent chat messages in a room
+type chatRing struct {
+	buf  []*ChatMessage
+	next int
+}
+
+func newChatRing(n int) *chatRing {
+	return &chatRing{buf: make([]*ChatMessage, 0, n)}
+}
+
+func (c *chatRing) push(m *ChatMessage) {
+	if len(c.buf) < cap(c.buf) {
+		c.buf = append(c.buf, m)
+		return
+	}
+	c.buf[c.next] = m
+	c.next = (c.next + 1) % len(c.buf)
+}
+
+// list returns the buffered messages from oldest to newest
+func (c *chatRing) list() []*ChatMessage {
+	l := make([]*ChatMessage, 0, len(c.buf))
+	l = append(l, c.buf[c.next:]...)
+	return append(l, c.buf[:c.next]...)
+}
+
+// BroadcastChat stamps a chat message from client c, stores it in the history
+// of room r and sends it to every client, NOT thread-safe
+func (r *Room) BroadcastChat(c *ClientConn, p *ChatMessage) error {
+	text := strings.TrimSpace(p.Text)
+	if text == "" || !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxChatLength {
+		return errors.New("invalid chat message")
+	}
+	chat := &ChatMessage{
+		ClientID:  c.ID,
+		Name:      c.name,
+		Text:      text,
+		Timestamp: timeToSeconds(time.Now()),
+	}
+	r.chat.push(chat)
+	r.broadcast(&Message{
+		Type:    MessageTypeChat,
+		Payload: chat,
+	}, nil)
+	return nil
+}
+
+// SendChatHistory sends the recent chat messages of room r to client c, NOT thread-safe
+func (r *Room) SendChatHistory(c *ClientConn) {
+	h := r.chat.list()
+	if len(h) == 0 {
+		return
+	}
+	r.send(c, &Message{
+		Type:    MessageTypeChatHistory,
+		Payload: &ChatHistoryMessage{Messages: h},
+	})
+}
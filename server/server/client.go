@@ -2,8 +2,11 @@ package server
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,24 +18,48 @@ const (
 
 // Client is a headless vChamber client, it cannot function as a master
 type Client struct {
+	nextID  uint64 // the last request ID, accessed atomically
 	Conn    *websocket.Conn
 	State   *PlaybackState
 	Latency time.Duration
 	Stop    chan bool
 	Stopped chan bool
+	// OnError and OnAck are called from the read loop for error and
+	// acknowledgement messages, errors are logged if OnError is nil
+	OnError func(*ErrorMessage)
+	OnAck   func(*AckMessage)
+	// the wire format negotiated with the server
+	Format WireFormat
 }
 
-// ClientHandleRecv is the read loop for vChamber client
+// ClientHandleRecv is the read loop for vChamber client, it returns once the
+// connection is closed
 func (c *Client) ClientHandleRecv() {
 	defer func() {
 		c.Conn.Close()
 	}()
 	for {
-		select {
-		// not implemented
-		case <-c.Stop:
+		_, b, err := c.Conn.ReadMessage()
+		if err != nil {
 			return
 		}
+		var m Message
+		if err := DeserialiseFrom(c.Format, b, &m); err != nil {
+			continue
+		}
+		switch m.Type {
+		case MessageTypeError:
+			p := m.Payload.(*ErrorMessage)
+			if c.OnError != nil {
+				c.OnError(p)
+			} else {
+				log.Printf("server error %s for request %q: %s", p.Code, p.RequestID, p.Message)
+			}
+		case MessageTypeAck:
+			if c.OnAck != nil {
+				c.OnAck(m.Payload.(*AckMessage))
+			}
+		}
 	}
 }
 
@@ -63,9 +90,16 @@ func (c *Client) ClientSendHeartbeat() {
 
 // SendMessage is a helper function to send a message from c
 func (c *Client) SendMessage(msg *Message) error {
-	b, _ := msg.Serialise()
+	b, _ := msg.SerialiseFor(c.Format)
 	c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	return c.Conn.WriteMessage(websocket.TextMessage, b)
+	return c.Conn.WriteMessage(c.Format.FrameType(), b)
+}
+
+// SendRequest sends msg from c with a fresh request ID, which it returns so
+// that errors and acks can be matched to it
+func (c *Client) SendRequest(msg *Message) (string, error) {
+	msg.ID = strconv.FormatUint(atomic.AddUint64(&c.nextID, 1), 10)
+	return msg.ID, c.SendMessage(msg)
 }
 
 // Connect initiates a new websocket connection to a vChamber server with given params
@@ -74,7 +108,11 @@ func Connect(dialer *websocket.Dialer, addr string, rid string, token string) (*
 		dialer = &websocket.Dialer{
 			Proxy:            http.ProxyFromEnvironment,
 			HandshakeTimeout: 45 * time.Second,
-			Subprotocols:     []string{WebsocketSubprotocolMagicV1},
+			Subprotocols: []string{
+				WebsocketSubprotocolMagicV2MsgPack,
+				WebsocketSubprotocolMagicV2,
+				WebsocketSubprotocolMagicV1,
+			},
 		}
 	}
 	u, err := url.Parse(addr)
@@ -97,8 +135,9 @@ func Connect(dialer *websocket.Dialer, addr string, rid string, token string) (*
 		return nil, err
 	}
 
+	format, _ := WireFormatOf(conn.Subprotocol())
 	var hello Message
-	err = Deserialise(b, &hello)
+	err = DeserialiseFrom(format, b, &hello)
 	if err != nil && hello.Type != MessageTypeHello {
 		conn.WriteMessage(websocket.CloseMessage, []byte{})
 		conn.Close()
@@ -114,5 +153,6 @@ func Connect(dialer *websocket.Dialer, addr string, rid string, token string) (*
 		Latency: time.Duration(0),
 		Stop:    make(chan bool),
 		Stopped: make(chan bool),
+		Format:  format,
 	}, nil
 }
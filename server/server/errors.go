@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"log"
+)
+
+// machine readable codes of protocol errors
+const (
+	ErrCodeBadMessage  = "bad_message"  // the message could not be decoded
+	ErrCodeUnknownType = "unknown_type" // the message type is unknown or not accepted from clients
+	ErrCodeForbidden   = "forbidden"    // the sender lacks the authority
+	ErrCodeInvalid     = "invalid"      // the payload is invalid
+	ErrCodeRateLimited = "rate_limited" // the sender sent too many messages of this type
+)
+
+// results of acknowledged state updates
+const (
+	AckApplied  = "applied"
+	AckBuffered = "buffered" // held back by the cooldown, another ack follows
+	AckRejected = "rejected"
+)
+
+var errUnknownMessageType = errors.New("unknown message type")
+
+// errorMessage builds an error reply to message m, which may be nil
+func errorMessage(m *Message, code string, text string) *Message {
+	p := &ErrorMessage{
+		Code:    code,
+		Message: text,
+	}
+	if m != nil {
+		p.RequestID = m.ID
+		if m.Type != messageTypeUnknown {
+			t := m.Type
+			p.RequestType = &t
+		}
+	}
+	return &Message{
+		Type:    MessageTypeError,
+		Payload: p,
+	}
+}
+
+// sendError tells client c that message m failed, NOT thread-safe
+func (r *Room) sendError(c *ClientConn, m *Message, code string, text string) {
+	log.Printf("error %s for message type %d from client %s: %s", code, m.Type, c, text)
+	r.send(c, errorMessage(m, code, text))
+}
+
+// reject tells client c that message m was rejected, with a rejected ack if
+// m is a state update whose sender asked for one and an error otherwise,
+// NOT thread-safe
+func (r *Room) reject(c *ClientConn, m *Message, code string, text string) {
+	if m.Type == MessageTypeStateUpdate && m.ID != "" {
+		log.Printf("rejected state update from client %s: %s", c, text)
+		r.ack(m, AckRejected, code)
+		return
+	}
+	r.sendError(c, m, code, text)
+}
+
+// ack acknowledges the state update in m if its sender asked for it by
+// setting a request ID, NOT thread-safe
+func (r *Room) ack(m *Message, result string, reason string) {
+	if m.ID == "" {
+		return
+	}
+	c, ok := r.clients[m.Sender]
+	if !ok {
+		return
+	}
+	r.send(c, &Message{
+		Type: MessageTypeAck,
+		Payload: &AckMessage{
+			RequestID: m.ID,
+			Result:    result,
+			Reason:    reason,
+			Version:   r.state.version,
+		},
+	})
+}
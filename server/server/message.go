@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 )
 
@@ -9,39 +10,241 @@ import (
 type Message struct {
 	Sender     string      `json:"-"`
 	ReceivedAt time.Time   `json:"-"`
+	ID         string      `json:"id,omitempty"` // optional request ID chosen by the client
 	Type       MessageType `json:"type"`
 	Payload    interface{} `json:"payload"`
+
+	encMutex sync.Mutex             // guards encoded
+	encoded  [numWireFormats][]byte // serialisations cached by Encode
 }
 type receivedMessage struct {
+	ID      string          `json:"id"`
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
 
+// HelloMessage tells a client its identity and authority, clients may send
+// one to set their display name and avatar
 type HelloMessage struct {
 	ClientType string `json:"authority"`
+	ClientID   string `json:"cid,omitempty"`
+	// nil when not given, a client clears its name or avatar with ""
+	Name   *string `json:"name,omitempty"`
+	Avatar *string `json:"avatar,omitempty"`
+	// v2 only, the protocol version and the optional features supported by
+	// the sender
+	Protocol     int      `json:"protocol,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
 	// State      *PlaybackStateMessage `json:"state"`
 }
 
 type PingMessage struct {
 	Timestamp float64 `json:"sendtime"`
+	RTT       float64 `json:"rtt,omitempty"` // the last round trip time measured by the client
 }
 
 type PongMessage struct {
 	Timestamp float64 `json:"sendtime"`
 	SvcTime   float64 `json:"servicetime"`
+	// the server clock when the pong was sent, in seconds since the epoch
+	ServerTime float64 `json:"servertime"`
 }
 
+// PlaybackStateMessage is the state of a room, fields marked as set by the
+// server are ignored in state updates
 type PlaybackStateMessage struct {
 	Source   string         `json:"src"`
 	Status   PlaybackStatus `json:"status"`
 	Position float64        `json:"position"`
-	Speed    float64        `json:"speed"`
-	Duration float64        `json:"duration"`
+	// set by the server, the server clock when Position was taken in seconds
+	// since the epoch
+	ServerTime float64 `json:"servertime,omitempty"`
+	// set by the server, when playback resumes after buffering in seconds
+	// since the epoch
+	StartAt       float64      `json:"startAt,omitempty"`
+	Speed         float64      `json:"speed"`
+	Duration      float64      `json:"duration"`
+	Mode          PlaybackMode `json:"mode"`    // set by the server
+	Version       uint64       `json:"version"` // set by the server
+	UpdatedBy     string       `json:"updatedBy,omitempty"`
+	UpdatedByName string       `json:"updatedByName,omitempty"`
+	Queue         []*MediaItem `json:"queue,omitempty"` // set by the server
+	Tracks        *TrackState  `json:"tracks,omitempty"`
+	// set by the server, the tracks chosen by the receiving client
+	Override *TrackOverrideMessage `json:"override,omitempty"`
 }
 
 type PlaybackStateUpdateMessage struct {
 	State *PlaybackStateMessage `json:"state"`
 	RTT   float64               `json:"rtt"`
+	// the version of the state the update is based on, 0 for last writer wins
+	BaseVersion uint64 `json:"baseVersion,omitempty"`
+}
+
+// ErrorMessage tells a client that one of its messages failed, RequestID and
+// RequestType are the ID and type of the offending message if they are known
+type ErrorMessage struct {
+	Code        string       `json:"code"`
+	Message     string       `json:"message,omitempty"`
+	RequestID   string       `json:"requestID,omitempty"`
+	RequestType *MessageType `json:"requestType,omitempty"`
+}
+
+// AckMessage acknowledges a state update that carried a request ID
+type AckMessage struct {
+	RequestID string `json:"requestID"`
+	Result    string `json:"result"`
+	Reason    string `json:"reason,omitempty"`
+	Version   uint64 `json:"version"` // the state version after the update
+}
+
+// ConflictMessage tells a master that its state update based on BaseVersion
+// was rejected, State is the current state to rebase on
+type ConflictMessage struct {
+	BaseVersion uint64                `json:"baseVersion"`
+	State       *PlaybackStateMessage `json:"state"`
+}
+
+// RoleChangeMessage names the client to be promoted or demoted
+type RoleChangeMessage struct {
+	ClientID string `json:"cid"`
+}
+
+// KickMessage names the client to be removed from the room
+type KickMessage struct {
+	ClientID string `json:"cid"`
+	Ban      bool   `json:"ban"`
+	Reason   string `json:"reason"`
+}
+
+// RosterEntry describes a client in a room, Latency is in seconds
+type RosterEntry struct {
+	ClientID  string  `json:"cid"`
+	Name      string  `json:"name,omitempty"`
+	Avatar    string  `json:"avatar,omitempty"`
+	Authority string  `json:"authority"`
+	Latency   float64 `json:"latency"`
+}
+
+type RosterMessage struct {
+	Clients []*RosterEntry `json:"clients"`
+}
+
+// PresenceMessage reports a client joining, leaving or changing role
+type PresenceMessage struct {
+	Event  string       `json:"event"`
+	Client *RosterEntry `json:"client"`
+}
+
+// ChatMessage is a chat line, clients only fill in Text and the server sets
+// the sender and the timestamp in seconds since the epoch
+type ChatMessage struct {
+	ClientID  string  `json:"cid"`
+	Name      string  `json:"name,omitempty"`
+	Text      string  `json:"text"`
+	Timestamp float64 `json:"time"`
+}
+
+type ChatHistoryMessage struct {
+	Messages []*ChatMessage `json:"messages"`
+}
+
+// ReactionMessage is an emoji reaction, clients only fill in Emoji and the
+// server sets the sender, the playback position and the timestamp
+type ReactionMessage struct {
+	ClientID  string  `json:"cid"`
+	Emoji     string  `json:"emoji"`
+	Position  float64 `json:"position"`
+	Timestamp float64 `json:"time"`
+}
+
+// ReactionBucket counts the reactions in the bucket of playback time
+// starting at Start
+type ReactionBucket struct {
+	Start  float64        `json:"start"`
+	Counts map[string]int `json:"counts"`
+}
+
+type ReactionTimelineMessage struct {
+	BucketSize float64           `json:"bucket"`
+	Buckets    []*ReactionBucket `json:"buckets"`
+}
+
+// MediaItem is an item in the queue of a room, the server assigns the ID
+type MediaItem struct {
+	ID       string  `json:"id"`
+	Source   string  `json:"src"`
+	Title    string  `json:"title,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// QueueItemMessage refers to an item in the queue, Index is only used when
+// moving an item
+type QueueItemMessage struct {
+	ID    string `json:"id"`
+	Index int    `json:"index,omitempty"`
+}
+
+// MediaTrack is a subtitle or audio track of the current media
+type MediaTrack struct {
+	ID       string `json:"id"`
+	Label    string `json:"label,omitempty"`
+	Language string `json:"lang,omitempty"`
+}
+
+// TrackState lists the tracks of the current media and the ones the room
+// selected, a selection is either a track ID, TrackOff or empty for the
+// player's default
+type TrackState struct {
+	Subtitles  []*MediaTrack `json:"subtitles,omitempty"`
+	Audio      []*MediaTrack `json:"audio,omitempty"`
+	Subtitle   string        `json:"subtitle,omitempty"`
+	AudioTrack string        `json:"audioTrack,omitempty"`
+}
+
+// TrackOverrideMessage selects tracks for one client only, empty selections
+// follow the room
+type TrackOverrideMessage struct {
+	Subtitle   string `json:"subtitle,omitempty"`
+	AudioTrack string `json:"audioTrack,omitempty"`
+}
+
+// TimeSyncMessage is an NTP style clock sync exchange, clients send T0 from
+// their clock along with T0 and their receive time T3 of the previous reply,
+// the server replies with its receive time T1, its send time T2 and its
+// estimate of the client clock offset and jitter, all in seconds since the epoch
+type TimeSyncMessage struct {
+	T0     float64 `json:"t0"`
+	PrevT0 float64 `json:"prevT0,omitempty"`
+	PrevT3 float64 `json:"prevT3,omitempty"`
+	T1     float64 `json:"t1,omitempty"`
+	T2     float64 `json:"t2,omitempty"`
+	Offset float64 `json:"offset,omitempty"` // server clock minus client clock
+	Jitter float64 `json:"jitter,omitempty"`
+}
+
+// ScheduledUpdateMessage is a state change that takes effect at server time
+// At in seconds since the epoch, the server announces it in advance and a
+// change without a state cancels the pending one
+type ScheduledUpdateMessage struct {
+	State     *PlaybackStateMessage `json:"state"`
+	At        float64               `json:"at"`
+	UpdatedBy string                `json:"updatedBy,omitempty"` // set by the server
+}
+
+// BufferingMessage reports whether a client's player is buffering
+type BufferingMessage struct {
+	Buffering bool `json:"buffering"`
+}
+
+// BufferingWaitMessage configures the room to wait for buffering clients
+type BufferingWaitMessage struct {
+	Enabled  bool    `json:"enabled"`
+	Fraction float64 `json:"fraction"`
+}
+
+type PlaybackModeMessage struct {
+	Mode PlaybackMode `json:"mode"`
 }
 
 type ReservedMessage json.RawMessage
@@ -56,6 +259,28 @@ const (
 	MessageTypePong
 	MessageTypeStateBroadcast
 	MessageTypeStateUpdate
+	MessageTypePromote
+	MessageTypeDemote
+	MessageTypeKick
+	MessageTypeRoster
+	MessageTypePresence
+	MessageTypeChat
+	MessageTypeChatHistory
+	MessageTypeReaction
+	MessageTypeReactionTimeline
+	MessageTypeEnqueue
+	MessageTypeDequeue
+	MessageTypeMoveItem
+	MessageTypeSkip
+	MessageTypeSetMode
+	MessageTypeTrackOverride
+	MessageTypeBuffering
+	MessageTypeBufferingWait
+	MessageTypeScheduleUpdate
+	MessageTypeTimeSync
+	MessageTypeConflict
+	MessageTypeError
+	MessageTypeAck
 	MessageTypeReserved MessageType = 99
 )
 
@@ -76,31 +301,120 @@ func Deserialise(data []byte, m *Message) error {
 	}
 
 	m.ReceivedAt = time.Now()
+	m.ID = rm.ID
 	m.Type = rm.Type
+	return decodePayload(m, rm.Payload, func(v interface{}) error {
+		return json.Unmarshal(rm.Payload, v)
+	})
+}
 
+// decodePayload decodes the payload of a message of type m.Type into m with
+// unmarshal, raw is the undecoded payload kept for reserved messages
+func decodePayload(m *Message, raw interface{}, unmarshal func(interface{}) error) error {
+	var err error
 	switch m.Type {
 	case MessageTypeHello:
 		var p HelloMessage
-		err = json.Unmarshal(rm.Payload, &p)
+		err = unmarshal(&p)
 		m.Payload = &p
 	case MessageTypePing:
 		var p PingMessage
-		err = json.Unmarshal(rm.Payload, &p)
+		err = unmarshal(&p)
 		m.Payload = &p
 	case MessageTypePong:
 		var p PongMessage
-		err = json.Unmarshal(rm.Payload, &p)
+		err = unmarshal(&p)
 		m.Payload = &p
 	case MessageTypeStateBroadcast:
 		var p PlaybackStateMessage
-		err = json.Unmarshal(rm.Payload, &p)
+		err = unmarshal(&p)
 		m.Payload = &p
 	case MessageTypeStateUpdate:
 		var p PlaybackStateUpdateMessage
-		err = json.Unmarshal(rm.Payload, &p)
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypePromote, MessageTypeDemote:
+		var p RoleChangeMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeKick:
+		var p KickMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeRoster:
+		var p RosterMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypePresence:
+		var p PresenceMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeChat:
+		var p ChatMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeChatHistory:
+		var p ChatHistoryMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeReaction:
+		var p ReactionMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeReactionTimeline:
+		var p ReactionTimelineMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeEnqueue:
+		var p MediaItem
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeDequeue, MessageTypeMoveItem:
+		var p QueueItemMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeSkip:
+		// no payload
+	case MessageTypeSetMode:
+		var p PlaybackModeMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeTrackOverride:
+		var p TrackOverrideMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeBuffering:
+		var p BufferingMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeBufferingWait:
+		var p BufferingWaitMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeScheduleUpdate:
+		var p ScheduledUpdateMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeTimeSync:
+		var p TimeSyncMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeConflict:
+		var p ConflictMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeError:
+		var p ErrorMessage
+		err = unmarshal(&p)
+		m.Payload = &p
+	case MessageTypeAck:
+		var p AckMessage
+		err = unmarshal(&p)
 		m.Payload = &p
 	case MessageTypeReserved:
-		m.Payload = rm.Payload
+		m.Payload = raw
+	default:
+		err = errUnknownMessageType
 	}
 	if err != nil {
 		return err
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// items that play for less than this in seconds at the current speed are
+// never played again by wrapAround, looping them would keep the room manager
+// busy broadcasting
+const minWrapDuration = 1.0
+
+func (m PlaybackMode) valid() bool {
+	return m >= PlaybackModeStop && m <= PlaybackModeShuffle
+}
+
+// setMode changes the playback mode of the room, NOT thread-safe
+func (r *Room) setMode(c *ClientConn, mode PlaybackMode) error {
+	if !mode.valid() {
+		return errors.New("invalid playback mode")
+	}
+	if r.state.mode == mode {
+		return nil
+	}
+	r.state.mode = mode
+	r.BroadcastState()
+	return nil
+}
+
+// currentItem returns the media item being played, NOT thread-safe
+func (r *Room) currentItem() *MediaItem {
+	st := r.state
+	if r.current != nil && r.current.Source == st.source {
+		return r.current
+	}
+	// the source was set by a state update rather than the queue
+	r.current = &MediaItem{
+		ID:       xid.New().String(),
+		Source:   st.source,
+		Duration: st.duration,
+	}
+	return r.current
+}
+
+// restartItem plays the current item again from the start as of time at, NOT thread-safe
+func (r *Room) restartItem(at time.Time) {
+	st := r.state
+	st.position = 0.0
+	st.status = PlaybackStatusPlaying
+	st.lastUpdated = at
+	r.bumpVersion()
+	r.scheduleEnd()
+}
+
+// wrapAround picks what to play after the current item ended at time at
+// according to the playback mode, it returns false if playback should stop,
+// NOT thread-safe
+func (r *Room) wrapAround(at time.Time) bool {
+	if r.state.duration < minWrapDuration*r.state.speed && r.state.mode != PlaybackModeStop {
+		// an item this short, or played this fast, ends as soon as it starts
+		return false
+	}
+	switch r.state.mode {
+	case PlaybackModeLoop:
+		r.restartItem(at)
+		return true
+	case PlaybackModeRepeat, PlaybackModeShuffle:
+		if len(r.queue) == 0 {
+			r.restartItem(at)
+			return true
+		}
+		if r.state.mode == PlaybackModeShuffle {
+			i := rand.Intn(len(r.queue))
+			r.queue[0], r.queue[i] = r.queue[i], r.queue[0]
+		}
+		r.queue = append(r.queue, r.currentItem())
+		return r.advanceQueue(at)
+	default:
+		return r.advanceQueue(at)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MessagePack messages have the same structure and field names as v2 JSON
+// messages, so the json struct tags are reused
+
+type receivedMessageMsgPack struct {
+	ID      string             `json:"id"`
+	Type    string             `json:"type"`
+	Payload msgpack.RawMessage `json:"payload"`
+}
+
+// msgpackUnmarshal decodes data into v like json.Unmarshal
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+	dec.Reset(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// msgpackEncoder is an encoder writing to its own buffer, both are reused
+// for every message so the encoder is only configured once
+type msgpackEncoder struct {
+	buf bytes.Buffer
+	enc *msgpack.Encoder
+}
+
+var msgpackEncoders = sync.Pool{
+	New: func() interface{} {
+		e := &msgpackEncoder{}
+		e.enc = msgpack.NewEncoder(&e.buf)
+		e.enc.SetCustomStructTag("json")
+		e.enc.UseCompactInts(true)
+		return e
+	},
+}
+
+// msgpackField is a struct field encoded under the name of its json tag
+type msgpackField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// msgpackFields caches the fields of the message structs by type
+var msgpackFields sync.Map
+
+// msgpackFieldsOf returns the encoded fields of struct type t
+func msgpackFieldsOf(t reflect.Type) []msgpackField {
+	if fs, ok := msgpackFields.Load(t); ok {
+		return fs.([]msgpackField)
+	}
+	var fs []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if sf.PkgPath != "" || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := msgpackField{name: opts[0], index: i}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		for _, o := range opts[1:] {
+			f.omitEmpty = f.omitEmpty || o == "omitempty"
+		}
+		fs = append(fs, f)
+	}
+	msgpackFields.Store(t, fs)
+	return fs
+}
+
+// isEmptyValue reports whether v is empty in the sense of the omitempty
+// option of encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// encodeMessageStruct encodes a message struct as a map keyed by the json
+// names of its fields, the encoder of the msgpack package allocates a list
+// of the remaining fields for every struct with omitempty fields, which
+// made MessagePack broadcasts allocate several times as much as JSON
+func encodeMessageStruct(e *msgpack.Encoder, v reflect.Value) error {
+	fs := msgpackFieldsOf(v.Type())
+	n := 0
+	for _, f := range fs {
+		if !f.omitEmpty || !isEmptyValue(v.Field(f.index)) {
+			n++
+		}
+	}
+	if err := e.EncodeMapLen(n); err != nil {
+		return err
+	}
+	for _, f := range fs {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if err := e.EncodeString(f.name); err != nil {
+			return err
+		}
+		if err := e.EncodeValue(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	for _, v := range []interface{}{
+		wireMessageV2{}, errorMessageV2{}, HelloMessage{}, PongMessage{},
+		PlaybackStateMessage{}, AckMessage{}, ConflictMessage{}, RosterEntry{},
+		RosterMessage{}, PresenceMessage{}, ChatMessage{}, ChatHistoryMessage{},
+		ReactionMessage{}, ReactionBucket{}, ReactionTimelineMessage{}, MediaItem{},
+		MediaTrack{}, TrackState{}, TrackOverrideMessage{}, TimeSyncMessage{},
+		ScheduledUpdateMessage{},
+	} {
+		msgpack.Register(v, encodeMessageStruct, nil)
+	}
+}
+
+// SerialiseMsgPack serialises m to the v2 MessagePack wire format
+func (m *Message) SerialiseMsgPack() ([]byte, error) {
+	e := msgpackEncoders.Get().(*msgpackEncoder)
+	defer msgpackEncoders.Put(e)
+	e.buf.Reset()
+	if err := e.enc.Encode(m.wireV2()); err != nil {
+		return nil, err
+	}
+	b := make([]byte, e.buf.Len())
+	copy(b, e.buf.Bytes())
+	return b, nil
+}
+
+// DeserialiseMsgPack decodes a message in the v2 MessagePack wire format in
+// data into m
+func DeserialiseMsgPack(data []byte, m *Message) error {
+	var rm receivedMessageMsgPack
+	if err := msgpackUnmarshal(data, &rm); err != nil {
+		return err
+	}
+	m.ReceivedAt = time.Now()
+	m.ID = rm.ID
+	t, ok := messageTypesByName[rm.Type]
+	if !ok {
+		m.Type = messageTypeUnknown
+		return errUnknownMessageType
+	}
+	m.Type = t
+	return decodePayload(m, rm.Payload, func(v interface{}) error {
+		return msgpackUnmarshal(rm.Payload, v)
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy is an allow-list of the page origins that may open a vChamber
+// websocket, entries are either "*", an exact origin such as
+// "https://vchamber.me", or a host pattern with an optional scheme and a
+// leading wildcard label such as "https://*.vchamber.me" or "*.vchamber.me"
+type OriginPolicy struct {
+	allowAll bool
+	patterns []originPattern
+}
+
+type originPattern struct {
+	scheme   string // empty to match any scheme
+	host     string // without the wildcard label
+	wildcard bool   // match strict subdomains of host only
+}
+
+// ParseOriginList splits a comma separated list of origins
+func ParseOriginList(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// NewOriginPolicy creates a policy allowing the given origins
+func NewOriginPolicy(origins []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{}
+	for _, o := range origins {
+		if o == "*" {
+			p.allowAll = true
+			continue
+		}
+		var pat originPattern
+		if i := strings.Index(o, "://"); i >= 0 {
+			pat.scheme = strings.ToLower(o[:i])
+			o = o[i+3:]
+		}
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		if strings.HasPrefix(o, "*.") {
+			pat.wildcard = true
+			o = o[2:]
+		}
+		if o == "" || strings.ContainsAny(o, "*/") {
+			return nil, errors.New("invalid origin pattern: " + o)
+		}
+		pat.host = o
+		p.patterns = append(p.patterns, pat)
+	}
+	return p, nil
+}
+
+func (pat *originPattern) match(u *url.URL) bool {
+	if pat.scheme != "" && pat.scheme != strings.ToLower(u.Scheme) {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if !strings.Contains(pat.host, ":") {
+		// a pattern without a port matches any port
+		host = strings.ToLower(u.Hostname())
+	}
+	if pat.wildcard {
+		return strings.HasSuffix(host, "."+pat.host)
+	}
+	return host == pat.host
+}
+
+// Check reports whether the origin of r is allowed, requests without an
+// Origin header do not come from browsers and are always allowed
+func (p *OriginPolicy) Check(r *http.Request) bool {
+	if p == nil || p.allowAll {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for i := range p.patterns {
+		if p.patterns[i].match(u) {
+			return true
+		}
+	}
+	return false
+}
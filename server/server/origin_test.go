@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicyCheck(t *testing.T) {
+	p, err := NewOriginPolicy(ParseOriginList(
+		"https://vchamber.me, https://*.vchamber.me, *.example.com, http://localhost:8080"))
+	if err != nil {
+		t.Fatalf("NewOriginPolicy: %v", err)
+	}
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"no origin header", "", true},
+		{"exact host", "https://vchamber.me", true},
+		{"exact host any port", "https://vchamber.me:8443", true},
+		{"exact host case", "HTTPS://VChamber.me", true},
+		{"exact host scheme mismatch", "http://vchamber.me", false},
+		{"exact host prefix", "https://evilvchamber.me", false},
+		{"exact host as subdomain", "https://vchamber.me.evil.com", false},
+		{"wildcard subdomain", "https://app.vchamber.me", true},
+		{"wildcard nested subdomain", "https://a.b.vchamber.me", true},
+		{"wildcard scheme mismatch", "http://app.vchamber.me", false},
+		{"wildcard any scheme", "http://app.example.com", true},
+		{"wildcard excludes apex", "https://example.com", false},
+		{"port match", "http://localhost:8080", true},
+		{"port mismatch", "http://localhost:9090", false},
+		{"port missing", "http://localhost", false},
+		{"opaque origin", "null", false},
+		{"malformed origin", "https://%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := p.Check(r); got != tt.want {
+				t.Fatalf("Check(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginPolicyAllowAll(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Origin", "https://anywhere.example")
+	var disabled *OriginPolicy
+	if !disabled.Check(r) {
+		t.Fatal("a nil policy rejected an origin")
+	}
+	p, err := NewOriginPolicy([]string{"https://vchamber.me", "*"})
+	if err != nil {
+		t.Fatalf("NewOriginPolicy: %v", err)
+	}
+	if !p.Check(r) {
+		t.Fatal(`a policy with "*" rejected an origin`)
+	}
+}
+
+func TestNewOriginPolicyInvalid(t *testing.T) {
+	for _, o := range []string{"https://", "*.", "a*b.com", "*.*.vchamber.me", "https://vchamber.me/path"} {
+		if _, err := NewOriginPolicy([]string{o}); err == nil {
+			t.Errorf("NewOriginPolicy(%q) accepted an invalid pattern", o)
+		}
+	}
+}
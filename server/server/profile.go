@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ErrInvalidProfile = "Error: Invalid display name or avatar"
+)
+
+const (
+	maxNameLength       = 32 // in runes
+	maxAvatarEmojiRunes = 8  // emoji sequences may combine several code points
+)
+
+// PresenceProfile is the presence event broadcast when a client changes its profile
+const PresenceProfile = "profile"
+
+var avatarColourPattern = regexp.MustCompile(`^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+
+// validateName trims a display name and checks that it is printable and not too long
+func validateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLength {
+		return "", errors.New("display name is too long")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", errors.New("display name contains unprintable characters")
+		}
+	}
+	return name, nil
+}
+
+// validateAvatar checks that an avatar is either a hex colour such as "#1e90ff"
+// or a single emoji
+func validateAvatar(avatar string) (string, error) {
+	avatar = strings.TrimSpace(avatar)
+	if avatar == "" || avatarColourPattern.MatchString(avatar) {
+		return avatar, nil
+	}
+	if _, err := validateEmoji(avatar); err != nil {
+		return "", errors.New("avatar must be a colour or an emoji")
+	}
+	return avatar, nil
+}
+
+// validateEmoji trims s and checks that it is a single emoji
+func validateEmoji(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxAvatarEmojiRunes {
+		return "", errors.New("not an emoji")
+	}
+	hasSymbol := false
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.So, r) || unicode.Is(unicode.Regional_Indicator, r):
+			hasSymbol = true
+		case r == '\u200d' || unicode.Is(unicode.Variation_Selector, r) ||
+			unicode.Is(unicode.Sk, r) || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r):
+			// joiners, variation selectors, skin tones and keycaps
+		default:
+			return "", errors.New("not an emoji")
+		}
+	}
+	if !hasSymbol {
+		return "", errors.New("not an emoji")
+	}
+	return s, nil
+}
+
+// validateProfile validates a display name and avatar
+func validateProfile(name string, avatar string) (string, string, error) {
+	name, err := validateName(name)
+	if err != nil {
+		return "", "", err
+	}
+	avatar, err = validateAvatar(avatar)
+	if err != nil {
+		return "", "", err
+	}
+	return name, avatar, nil
+}
+
+// String describes c for log lines, NOT thread-safe
+func (c *ClientConn) String() string {
+	if c.name == "" {
+		return c.ID
+	}
+	return c.ID + " (" + c.name + ")"
+}
+
+// optionalString returns nil for an empty string s, otherwise a pointer to s
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// updateProfile applies the profile in a Hello message from client c and
+// tells the room about it, fields missing from the Hello are kept, NOT thread-safe
+func (r *Room) updateProfile(c *ClientConn, p *HelloMessage) error {
+	if p.Name == nil && p.Avatar == nil {
+		// e.g. a v2 Hello that only declares capabilities
+		return nil
+	}
+	name, avatar := c.name, c.avatar
+	if p.Name != nil {
+		name = *p.Name
+	}
+	if p.Avatar != nil {
+		avatar = *p.Avatar
+	}
+	name, avatar, err := validateProfile(name, avatar)
+	if err != nil {
+		return err
+	}
+	if name == c.name && avatar == c.avatar {
+		return nil
+	}
+	log.Printf("client %s in room %s is now known as %q", c, r.ID, name)
+	c.name = name
+	c.avatar = avatar
+	r.BroadcastPresence(PresenceProfile, c)
+	return nil
+}
@@ -12,12 +12,28 @@ const (
 	PlaybackStatusPaused  PlaybackStatus = 2
 )
 
+// PlaybackMode is the enum for what a room plays once the current item ends
+type PlaybackMode int
+
+// PlaybackMode enum instances
+const (
+	PlaybackModeStop    PlaybackMode = 0 // play the rest of the queue, then stop
+	PlaybackModeLoop    PlaybackMode = 1 // loop the current item
+	PlaybackModeRepeat  PlaybackMode = 2 // repeat the queue including the current item
+	PlaybackModeShuffle PlaybackMode = 3 // like repeat but in random order
+)
+
 // PlaybackState describes the media playback state in a room
 type PlaybackState struct {
-	source      string
-	status      PlaybackStatus
-	position    float64
-	speed       float64
-	duration    float64
-	lastUpdated time.Time
+	source        string
+	status        PlaybackStatus
+	position      float64
+	speed         float64
+	duration      float64
+	mode          PlaybackMode
+	version       uint64      // bumped on every change to the playback state
+	tracks        *TrackState // replaced rather than modified once set
+	lastUpdated   time.Time
+	updatedBy     string // the client that made the last update
+	updatedByName string
 }
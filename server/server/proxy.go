@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies lists the reverse proxies in front of a server, the
+// X-Forwarded-For header is only honoured on requests coming from one of
+// them, entries are IP addresses such as "10.0.0.2" or networks such as
+// "10.0.0.0/8"
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies creates a list trusting the given addresses and networks
+func NewTrustedProxies(addrs []string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, errors.New("invalid proxy address: " + a)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, errors.New("invalid proxy network: " + a)
+		}
+		p.nets = append(p.nets, n)
+	}
+	return p, nil
+}
+
+// trusts reports whether addr belongs to a trusted proxy
+func (p *TrustedProxies) trusts(addr string) bool {
+	if p == nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the address request r originates from, every proxy
+// appends the address it was connected from to X-Forwarded-For so the
+// rightmost entry not added by a trusted proxy is the client, the entries
+// before it are supplied by the client and cannot be trusted, own is false
+// if addr belongs to a proxy and is shared by all of its clients
+func (p *TrustedProxies) clientAddress(r *http.Request) (addr string, own bool) {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !p.trusts(addr) {
+		// a request relayed by a proxy we do not trust still carries the
+		// header, the address is then that of the proxy
+		return addr, len(r.Header["X-Forwarded-For"]) == 0
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !p.trusts(hop) {
+			return addr, true
+		}
+	}
+	return addr, false
+}
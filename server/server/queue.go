@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/xid"
+)
+
+const (
+	maxQueueLength  = 100
+	maxTitleLength  = 200 // in runes
+	maxSourceLength = 2048
+	// in seconds, longer durations and positions overflow a time.Duration
+	// once divided by a small speed
+	maxMediaDuration = 3 * 24 * 60 * 60
+	// the end timer is rearmed by the room manager if it fires early
+	maxEndDelay = 24 * time.Hour
+)
+
+// validateMediaItem checks a media item sent by a client and returns a copy
+// of it with a fresh ID
+func validateMediaItem(p *MediaItem) (*MediaItem, error) {
+	src := strings.TrimSpace(p.Source)
+	if src == "" || len(src) > maxSourceLength {
+		return nil, errors.New("invalid source")
+	}
+	title := strings.TrimSpace(p.Title)
+	if !utf8.ValidString(title) || utf8.RuneCountInString(title) > maxTitleLength {
+		return nil, errors.New("invalid title")
+	}
+	if p.Duration <= 0 || p.Duration > maxMediaDuration || math.IsNaN(p.Duration) {
+		return nil, errors.New("invalid duration")
+	}
+	return &MediaItem{
+		ID:       xid.New().String(),
+		Source:   src,
+		Title:    title,
+		Duration: p.Duration,
+	}, nil
+}
+
+// queueIndex returns the position of item id in the queue or -1, NOT thread-safe
+func (r *Room) queueIndex(id string) int {
+	for i, item := range r.queue {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// enqueue appends an item sent by client c to the queue, NOT thread-safe
+func (r *Room) enqueue(c *ClientConn, p *MediaItem) error {
+	if len(r.queue) >= maxQueueLength {
+		return errors.New("the queue is full")
+	}
+	item, err := validateMediaItem(p)
+	if err != nil {
+		return err
+	}
+	r.queue = append(r.queue, item)
+	r.BroadcastState()
+	return nil
+}
+
+// dequeue removes item id from the queue, NOT thread-safe
+func (r *Room) dequeue(id string) {
+	i := r.queueIndex(id)
+	if i < 0 {
+		return
+	}
+	r.queue = append(r.queue[:i], r.queue[i+1:]...)
+	r.BroadcastState()
+}
+
+// moveItem moves item id to position to in the queue, NOT thread-safe
+func (r *Room) moveItem(id string, to int) {
+	i := r.queueIndex(id)
+	if i < 0 {
+		return
+	}
+	if to < 0 {
+		to = 0
+	} else if to >= len(r.queue) {
+		to = len(r.queue) - 1
+	}
+	item := r.queue[i]
+	r.queue = append(r.queue[:i], r.queue[i+1:]...)
+	r.queue = append(r.queue[:to], append([]*MediaItem{item}, r.queue[to:]...)...)
+	r.BroadcastState()
+}
+
+// skip starts playing the next item in the queue right away, NOT thread-safe
+func (r *Room) skip() {
+	if r.advanceQueue(time.Now()) {
+		r.BroadcastState()
+	}
+}
+
+// advanceQueue pops the next item off the queue and plays it from the start
+// as of time at, it returns false if the queue is empty, NOT thread-safe
+func (r *Room) advanceQueue(at time.Time) bool {
+	if len(r.queue) == 0 {
+		return false
+	}
+	item := r.queue[0]
+	r.queue[0] = nil
+	r.queue = r.queue[1:]
+	r.current = item
+	log.Printf("room %s advanced to %s", r.ID, item.Source)
+
+	st := r.state
+	if item.Source != st.source {
+		r.resetSource()
+	}
+	st.source = item.Source
+	st.duration = item.Duration
+	st.position = 0.0
+	st.status = PlaybackStatusPlaying
+	st.lastUpdated = at
+	st.updatedBy = ""
+	st.updatedByName = ""
+	r.bumpVersion()
+	r.scheduleEnd()
+	return true
+}
+
+// scheduleEnd arms the end timer for when the current item finishes playing, NOT thread-safe
+func (r *Room) scheduleEnd() {
+	st := r.state
+	r.endTimer.Stop()
+	if st.status != PlaybackStatusPlaying || st.speed <= 0 {
+		return
+	}
+	remaining := (st.duration - st.position) / st.speed
+	elapsed := time.Since(st.lastUpdated).Seconds()
+	delay := math.Max(math.Min(remaining-elapsed, maxEndDelay.Seconds()), 0.0)
+	r.endTimer.Reset(time.Duration(delay * float64(time.Second)))
+}
+
+// queueSnapshot copies the queue for a state broadcast, NOT thread-safe
+func (r *Room) queueSnapshot() []*MediaItem {
+	if len(r.queue) == 0 {
+		return nil
+	}
+	q := make([]*MediaItem, len(r.queue))
+	copy(q, r.queue)
+	return q
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	reactionBucketSize = 5.0  // seconds of playback per timeline bucket
+	maxReactionBuckets = 2048 // caps the timeline of very long media
+	maxReactionKinds   = 16   // distinct emoji per bucket
+	reactionRate       = 2.0  // reactions per second allowed per client
+	reactionBurst      = 5.0
+)
+
+// rateLimiter is a token bucket, NOT thread-safe
+type rateLimiter struct {
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket if there is one
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1.0 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// reactionTimeline counts reactions per emoji in buckets of playback time
+type reactionTimeline map[int]map[string]int
+
+func (t reactionTimeline) add(position float64, emoji string) {
+	b := int(math.Floor(math.Max(position, 0.0) / reactionBucketSize))
+	counts, ok := t[b]
+	if !ok {
+		if len(t) >= maxReactionBuckets {
+			return
+		}
+		counts = make(map[string]int)
+		t[b] = counts
+	}
+	if _, ok := counts[emoji]; !ok && len(counts) >= maxReactionKinds {
+		return
+	}
+	counts[emoji]++
+}
+
+func (t reactionTimeline) message() *ReactionTimelineMessage {
+	keys := make([]int, 0, len(t))
+	for b := range t {
+		keys = append(keys, b)
+	}
+	sort.Ints(keys)
+	buckets := make([]*ReactionBucket, 0, len(keys))
+	for _, b := range keys {
+		buckets = append(buckets, &ReactionBucket{
+			Start:  float64(b) * reactionBucketSize,
+			Counts: t[b],
+		})
+	}
+	return &ReactionTimelineMessage{
+		BucketSize: reactionBucketSize,
+		Buckets:    buckets,
+	}
+}
+
+// BroadcastReaction stamps a reaction from client c with the current playback
+// position, adds it to the timeline and sends it to every client, NOT thread-safe
+func (r *Room) BroadcastReaction(c *ClientConn, p *ReactionMessage) error {
+	emoji, err := validateEmoji(p.Emoji)
+	if err != nil {
+		return err
+	}
+	reaction := &ReactionMessage{
+		ClientID:  c.ID,
+		Emoji:     emoji,
+		Position:  r.currentPosition(),
+		Timestamp: timeToSeconds(time.Now()),
+	}
+	r.reactions.add(reaction.Position, emoji)
+	r.broadcast(&Message{
+		Type:    MessageTypeReaction,
+		Payload: reaction,
+	}, nil)
+	return nil
+}
+
+// SendReactionTimeline sends the reaction timeline of the current media to
+// client c, NOT thread-safe
+func (r *Room) SendReactionTimeline(c *ClientConn) {
+	if len(r.reactions) == 0 {
+		return
+	}
+	r.send(c, &Message{
+		Type:    MessageTypeReactionTimeline,
+		Payload: r.reactions.message(),
+	})
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -11,8 +14,32 @@ import (
 
 const (
 	roomCreationTimeOut = 5 * time.Second
+	maxRequestBodySize  = 1 << 16
 )
 
+// bounds on the room options accepted by the room creation endpoint
+const (
+	minBroadcastPeriod   = 500 * time.Millisecond
+	maxBroadcastPeriod   = 1 * time.Minute
+	maxMasterlessTimeout = 24 * time.Hour
+	maxUpdateCooldown    = 10 * time.Second
+)
+
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// CreateRoomRequest is the optional JSON body of a room creation request,
+// zero values fall back to the server defaults and durations are in seconds
+type CreateRoomRequest struct {
+	RoomID            string  `json:"roomID"`
+	Source            string  `json:"src"`
+	Duration          float64 `json:"duration"`
+	MasterlessTimeout float64 `json:"masterlessTimeout"`
+	BroadcastPeriod   float64 `json:"broadcastPeriod"`
+	UpdateCooldown    float64 `json:"updateCooldown"`
+	WaitForBuffering  bool    `json:"waitForBuffering"`
+	BufferingFraction float64 `json:"bufferingFraction"`
+}
+
 type ServerInfoMsg struct {
 	OK    bool     `json:"ok"`
 	NRoom int      `json:"nroom"`
@@ -20,16 +47,72 @@ type ServerInfoMsg struct {
 }
 
 type RoomCreatedMsg struct {
-	OK        bool   `json:"ok"`
-	RoomID    string `json:"roomID"`
-	MasterKey string `json:"masterToken"`
-	GuestKey  string `json:"guestToken"`
+	OK              bool   `json:"ok"`
+	RoomID          string `json:"roomID"`
+	MasterKey       string `json:"masterToken"`
+	GuestKey        string `json:"guestToken"`
+	SignedMasterKey string `json:"signedMasterToken,omitempty"`
+	SignedGuestKey  string `json:"signedGuestToken,omitempty"`
 }
 
 type RoomInfo struct {
+	RoomID string       `json:"roomID"`
+	Tokens []*TokenInfo `json:"tokens"`
+}
+
+type RoomDetailMsg struct {
+	OK          bool                  `json:"ok"`
+	RoomID      string                `json:"roomID"`
+	Authority   string                `json:"authority"`
+	State       *PlaybackStateMessage `json:"state"`
+	NMaster     int                   `json:"nmaster"`
+	NGuest      int                   `json:"nguest"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	SinceUpdate float64               `json:"sinceUpdate"`
+}
+
+// RotateKeysRequest is the JSON body of a key rotation request
+type RotateKeysRequest struct {
+	Master     bool `json:"master"`
+	Guest      bool `json:"guest"`
+	Disconnect bool `json:"disconnect"`
+}
+
+type RoomKeysMsg struct {
+	OK        bool   `json:"ok"`
 	RoomID    string `json:"roomID"`
-	MasterKey string `json:"masterToken"`
-	GuestKey  string `json:"guestToken"`
+	MasterKey string `json:"masterToken,omitempty"`
+	GuestKey  string `json:"guestToken,omitempty"`
+}
+
+// MintTokenRequest is the JSON body of an invite token creation request
+type MintTokenRequest struct {
+	Label     string    `json:"label"`
+	Authority string    `json:"authority"`
+	Expires   time.Time `json:"expires"`
+	MaxUses   int       `json:"maxUses"`
+}
+
+type TokenMintedMsg struct {
+	OK    bool       `json:"ok"`
+	Token *TokenInfo `json:"token"`
+}
+
+// SignedInviteRequest is the JSON body of a signed invite request, TTL is in seconds
+type SignedInviteRequest struct {
+	Authority string  `json:"authority"`
+	TTL       float64 `json:"ttl"`
+}
+
+type SignedInviteMsg struct {
+	OK      bool      `json:"ok"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type TokenListMsg struct {
+	OK     bool         `json:"ok"`
+	Tokens []*TokenInfo `json:"tokens"`
 }
 
 type AllRoomInfoMsg struct {
@@ -79,9 +162,8 @@ func getAllRoomInfo(s *Server, w http.ResponseWriter, r *http.Request) {
 	s.mutex.RLock()
 	for _, rm := range s.rooms {
 		rms = append(rms, &RoomInfo{
-			RoomID:    rm.ID,
-			MasterKey: rm.masterKey,
-			GuestKey:  rm.guestKey,
+			RoomID: rm.ID,
+			Tokens: rm.ListTokens(),
 		})
 	}
 	s.mutex.RUnlock()
@@ -91,22 +173,98 @@ func getAllRoomInfo(s *Server, w http.ResponseWriter, r *http.Request) {
 	}, http.StatusOK, w)
 }
 
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// options validates req and converts it to room options
+func (req *CreateRoomRequest) options() (RoomOptions, error) {
+	opts := DefaultRoomOptions()
+	if req.RoomID != "" && !roomIDPattern.MatchString(req.RoomID) {
+		return opts, errors.New("roomID must be 3 to 64 letters, digits, '-' or '_'")
+	}
+	if req.Duration < 0 || req.MasterlessTimeout < 0 ||
+		req.BroadcastPeriod < 0 || req.UpdateCooldown < 0 {
+		return opts, errors.New("durations must not be negative")
+	}
+	if req.MasterlessTimeout > 0 {
+		opts.MasterlessTimeout = secondsToDuration(req.MasterlessTimeout)
+	}
+	if req.BroadcastPeriod > 0 {
+		opts.BroadcastPeriod = secondsToDuration(req.BroadcastPeriod)
+	}
+	if req.UpdateCooldown > 0 {
+		opts.UpdateCooldown = secondsToDuration(req.UpdateCooldown)
+	}
+	if req.Duration > maxMediaDuration {
+		return opts, errors.New("duration is too long")
+	}
+	if opts.MasterlessTimeout > maxMasterlessTimeout {
+		return opts, errors.New("masterlessTimeout is too long")
+	}
+	if opts.BroadcastPeriod < minBroadcastPeriod || opts.BroadcastPeriod > maxBroadcastPeriod {
+		return opts, errors.New("broadcastPeriod is out of range")
+	}
+	if opts.UpdateCooldown > maxUpdateCooldown {
+		return opts, errors.New("updateCooldown is too long")
+	}
+	if !validBufferingFraction(req.BufferingFraction) {
+		return opts, errors.New("bufferingFraction must be between 0 and 1")
+	}
+	opts.WaitForBuffering = req.WaitForBuffering
+	opts.BufferingFraction = req.BufferingFraction
+	return opts, nil
+}
+
+// decodeJSONBody decodes an optional JSON request body into v, an empty body
+// leaves v untouched
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
 func createRoom(s *Server, w http.ResponseWriter, r *http.Request) {
-	rid := xid.New().String()
-	room, mk, gk, err := NewRoomWithRandomKeys(rid, s)
+	var req CreateRoomRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		RespondWithError("Malformed room creation request.", http.StatusBadRequest, w)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		RespondWithError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+	rid := req.RoomID
+	if rid == "" {
+		rid = xid.New().String()
+	}
+	room, mk, gk, err := NewRoomWithRandomKeys(rid, s, opts)
 	if err != nil {
 		RespondWithError("An internal error occurred.",
 			http.StatusInternalServerError, w)
 		return
 	}
+	room.state.source = req.Source
+	room.state.duration = req.Duration
+	reg := newRoomRegistration(room)
 	t := time.After(roomCreationTimeOut)
 	select {
-	case s.enqRoom <- room:
+	case s.enqRoom <- reg:
+		if err := <-reg.result; err != nil {
+			RespondWithError(err.Error(), http.StatusConflict, w)
+			return
+		}
 		rsp := RoomCreatedMsg{
-			true,
-			rid,
-			mk,
-			gk,
+			OK:        true,
+			RoomID:    rid,
+			MasterKey: mk,
+			GuestKey:  gk,
 		}
 		RespondWithJSON(rsp, http.StatusOK, w)
 	case <-t:
@@ -118,12 +276,216 @@ func createRoom(s *Server, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func getRoomInfo(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := s.LookupRoom(mux.Vars(r)["rid"])
+	if room == nil {
+		RespondWithError(ErrInvalidRoomID, http.StatusNotFound, w)
+		return
+	}
+	cState := room.authorise(r.URL.Query().Get("token"))
+	if cState == clientStateUnauthorised {
+		RespondWithError(ErrInvalidToken, http.StatusUnauthorized, w)
+		return
+	}
+	rsp := RoomDetailMsg{
+		OK:        true,
+		RoomID:    room.ID,
+		Authority: cState.String(),
+		CreatedAt: room.createdAt,
+	}
+	ok := room.exec(func() {
+		rsp.State = room.GetCurrentStateMessage().Payload.(*PlaybackStateMessage)
+		rsp.NMaster = len(room.masters)
+		rsp.NGuest = len(room.clients) - len(room.masters)
+		rsp.SinceUpdate = time.Since(room.state.lastUpdated).Seconds()
+	})
+	if !ok {
+		RespondWithError(ErrInvalidRoomID, http.StatusNotFound, w)
+		return
+	}
+	RespondWithJSON(rsp, http.StatusOK, w)
+}
+
+func rotateRoomKeys(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	var req RotateKeysRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		RespondWithError("Malformed key rotation request.", http.StatusBadRequest, w)
+		return
+	}
+	if !req.Master && !req.Guest {
+		RespondWithError("Nothing to rotate.", http.StatusBadRequest, w)
+		return
+	}
+	mk, gk, err := room.RotateKeys(req.Master, req.Guest)
+	if err != nil {
+		RespondWithError("An internal error occurred.",
+			http.StatusInternalServerError, w)
+		return
+	}
+	if req.Disconnect {
+		room.exec(func() {
+			if req.Master {
+				room.kickByToken(MasterTokenID)
+				room.kickSigned(clientStateMaster)
+			}
+			if req.Guest {
+				room.kickByToken(GuestTokenID)
+				room.kickSigned(clientStateGuest)
+			}
+		})
+	}
+	RespondWithJSON(&RoomKeysMsg{
+		true,
+		room.ID,
+		mk,
+		gk,
+	}, http.StatusOK, w)
+}
+
+// masterRoom returns the room addressed by r if r carries a master token of
+// it, otherwise it responds with an error and returns nil
+func masterRoom(s *Server, w http.ResponseWriter, r *http.Request) *Room {
+	room := s.LookupRoom(mux.Vars(r)["rid"])
+	if room == nil {
+		RespondWithError(ErrInvalidRoomID, http.StatusNotFound, w)
+		return nil
+	}
+	if !room.CheckMasterKey(r.URL.Query().Get("token")) {
+		RespondWithError(ErrInvalidToken, http.StatusUnauthorized, w)
+		return nil
+	}
+	return room
+}
+
+func mintRoomToken(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	var req MintTokenRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		RespondWithError("Malformed token creation request.", http.StatusBadRequest, w)
+		return
+	}
+	if req.Authority == "" {
+		req.Authority = clientStateGuest.String()
+	}
+	t, err := room.MintToken(req.Label, req.Authority, req.Expires, req.MaxUses)
+	if err != nil {
+		RespondWithError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+	RespondWithJSON(&TokenMintedMsg{true, t}, http.StatusOK, w)
+}
+
+func listRoomTokens(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	RespondWithJSON(&TokenListMsg{true, room.ListTokens()}, http.StatusOK, w)
+}
+
+func revokeRoomToken(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	tid := mux.Vars(r)["tid"]
+	if !room.RevokeToken(tid) {
+		RespondWithError("No such token.", http.StatusNotFound, w)
+		return
+	}
+	if r.URL.Query().Get("disconnect") != "" {
+		room.exec(func() {
+			room.kickByToken(tid)
+		})
+	}
+	RespondWithJSON(map[string]bool{
+		"ok": true,
+	}, http.StatusOK, w)
+}
+
+func signRoomInvite(s *Server, w http.ResponseWriter, r *http.Request) {
+	if s.signer == nil {
+		RespondWithError("Signed tokens are not enabled.", http.StatusNotImplemented, w)
+		return
+	}
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	var req SignedInviteRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		RespondWithError("Malformed invite request.", http.StatusBadRequest, w)
+		return
+	}
+	if req.Authority == "" {
+		req.Authority = clientStateGuest.String()
+	}
+	if parseRole(req.Authority) == clientStateUnauthorised {
+		RespondWithError("authority must be master or guest", http.StatusBadRequest, w)
+		return
+	}
+	ttl := DefaultSignedTokenTTL
+	if req.TTL < 0 {
+		RespondWithError("ttl must not be negative", http.StatusBadRequest, w)
+		return
+	} else if req.TTL > 0 {
+		ttl = secondsToDuration(req.TTL)
+	}
+	if ttl > maxSignedTokenTTL {
+		RespondWithError("ttl is too long", http.StatusBadRequest, w)
+		return
+	}
+	c := room.newTokenClaims(req.Authority, ttl)
+	t, err := s.signer.Sign(c)
+	if err != nil {
+		RespondWithError("An internal error occurred.",
+			http.StatusInternalServerError, w)
+		return
+	}
+	RespondWithJSON(&SignedInviteMsg{true, t, time.Unix(c.Expires, 0)}, http.StatusOK, w)
+}
+
+func kickRoomClient(s *Server, w http.ResponseWriter, r *http.Request) {
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	q := r.URL.Query()
+	cid := mux.Vars(r)["cid"]
+	found := false
+	room.exec(func() {
+		found = room.kick(cid, q.Get("ban") != "", q.Get("reason"))
+	})
+	if !found {
+		RespondWithError("No such client.", http.StatusNotFound, w)
+		return
+	}
+	RespondWithJSON(map[string]bool{
+		"ok": true,
+	}, http.StatusOK, w)
+}
+
 func destroyRoom(s *Server, w http.ResponseWriter, r *http.Request) {
-	RespondWithError("DestroyRoom not implemented", http.StatusNotImplemented, w)
+	room := masterRoom(s, w, r)
+	if room == nil {
+		return
+	}
+	s.RemoveRoom(room)
+	RespondWithJSON(map[string]bool{
+		"ok": true,
+	}, http.StatusOK, w)
 }
 
-// NewVChamberRestMux makes the RESTful API servemux of server
-func NewVChamberRestMux(server *Server) *mux.Router {
+// NewVChamberRestMux makes the RESTful API servemux of server, administrative
+// endpoints are guarded by admin
+func NewVChamberRestMux(server *Server, admin *AdminAuth) *mux.Router {
 	restMux := mux.NewRouter().StrictSlash(true)
 	restMux.HandleFunc("/room", func(w http.ResponseWriter, r *http.Request) {
 		createRoom(server, w, r)
@@ -131,15 +493,35 @@ func NewVChamberRestMux(server *Server) *mux.Router {
 	restMux.HandleFunc("/server", func(w http.ResponseWriter, r *http.Request) {
 		getServerInfo(server, w, r)
 	}).Methods("GET")
-	restMux.HandleFunc("/server", func(w http.ResponseWriter, r *http.Request) {
+	restMux.HandleFunc("/server", admin.WrapFunc(func(w http.ResponseWriter, r *http.Request) {
 		destroyServer(server, w, r)
-	}).Methods("DELETE")
-	restMux.HandleFunc("/allroom", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("DELETE")
+	restMux.HandleFunc("/allroom", admin.WrapFunc(func(w http.ResponseWriter, r *http.Request) {
 		getAllRoomInfo(server, w, r)
+	})).Methods("GET")
+	restMux.HandleFunc("/room/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		getRoomInfo(server, w, r)
 	}).Methods("GET")
-
-	// restMux.HandleFunc("/room/{rid}", func(w http.ResponseWriter, r *http.Request) {
-	// 	destroyRoom(server, w, r)
-	// }).Methods("DELETE")
+	restMux.HandleFunc("/room/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		destroyRoom(server, w, r)
+	}).Methods("DELETE")
+	restMux.HandleFunc("/room/{rid}/keys", func(w http.ResponseWriter, r *http.Request) {
+		rotateRoomKeys(server, w, r)
+	}).Methods("POST")
+	restMux.HandleFunc("/room/{rid}/token", func(w http.ResponseWriter, r *http.Request) {
+		listRoomTokens(server, w, r)
+	}).Methods("GET")
+	restMux.HandleFunc("/room/{rid}/token", func(w http.ResponseWriter, r *http.Request) {
+		mintRoomToken(server, w, r)
+	}).Methods("POST")
+	restMux.HandleFunc("/room/{rid}/token/{tid}", func(w http.ResponseWriter, r *http.Request) {
+		revokeRoomToken(server, w, r)
+	}).Methods("DELETE")
+	restMux.HandleFunc("/room/{rid}/client/{cid}", func(w http.ResponseWriter, r *http.Request) {
+		kickRoomClient(server, w, r)
+	}).Methods("DELETE")
+	restMux.HandleFunc("/room/{rid}/invite", func(w http.ResponseWriter, r *http.Request) {
+		signRoomInvite(server, w, r)
+	}).Methods("POST")
 	return restMux
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// presence events broadcast to a room
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+	PresenceRole  = "role"
+)
+
+// Latency returns the round trip time last reported by c
+func (c *ClientConn) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
+}
+
+func (c *ClientConn) setLatency(rtt float64) {
+	if rtt > 0 && isFinite(rtt) {
+		atomic.StoreInt64(&c.latency, int64(secondsToDuration(rtt)))
+	}
+}
+
+// rosterEntry describes c for other clients, NOT thread-safe
+func (c *ClientConn) rosterEntry() *RosterEntry {
+	return &RosterEntry{
+		ClientID:  c.ID,
+		Name:      c.name,
+		Avatar:    c.avatar,
+		Authority: c.state.String(),
+		Latency:   c.Latency().Seconds(),
+	}
+}
+
+// SendRoster sends the list of all clients in room r to client cid, NOT thread-safe
+func (r *Room) SendRoster(cid string) {
+	c, ok := r.clients[cid]
+	if !ok {
+		return
+	}
+	entries := make([]*RosterEntry, 0, len(r.clients))
+	for _, o := range r.clients {
+		entries = append(entries, o.rosterEntry())
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ClientID < entries[j].ClientID })
+	r.send(c, &Message{
+		Type:    MessageTypeRoster,
+		Payload: &RosterMessage{Clients: entries},
+	})
+}
+
+// BroadcastPresence notifies every client in room r but c of an event
+// concerning c, NOT thread-safe
+func (r *Room) BroadcastPresence(event string, c *ClientConn) {
+	select {
+	case <-r.closing:
+		// nobody cares while the room is being torn down
+		return
+	default:
+	}
+	r.broadcast(&Message{
+		Type: MessageTypePresence,
+		Payload: &PresenceMessage{
+			Event:  event,
+			Client: c.rosterEntry(),
+		},
+	}, c)
+}
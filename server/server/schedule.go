@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// maxScheduleLead limits how far in the future a change can be scheduled
+	maxScheduleLead = 24 * time.Hour
+	// maxScheduleLag limits how far in the past a change can be scheduled,
+	// to allow for a client whose clock is slightly behind
+	maxScheduleLag = 2 * time.Second
+)
+
+// scheduledUpdate is a state change that takes effect at a given server time
+type scheduledUpdate struct {
+	state  *PlaybackStateMessage
+	at     time.Time
+	sender string
+}
+
+// scheduleUpdate schedules the state change in p sent by client c, a change
+// without a state cancels the pending one, NOT thread-safe
+func (r *Room) scheduleUpdate(c *ClientConn, p *ScheduledUpdateMessage) error {
+	if p.State == nil {
+		r.cancelScheduled()
+		return nil
+	}
+	if !isFinite(p.At) {
+		return errors.New("invalid schedule time")
+	}
+	if err := validateState(p.State); err != nil {
+		return err
+	}
+	at := secondsToTime(p.At)
+	if time.Until(at) > maxScheduleLead {
+		return errors.New("the change is scheduled too far ahead")
+	}
+	if time.Since(at) > maxScheduleLag {
+		return errors.New("the change is scheduled in the past")
+	}
+	r.scheduled = &scheduledUpdate{
+		state:  p.State,
+		at:     at,
+		sender: c.ID,
+	}
+	log.Printf("client %s scheduled a change in room %s at %v", c, r.ID, at)
+	r.scheduleTimer.Stop()
+	r.scheduleTimer.Reset(time.Until(at))
+	r.BroadcastScheduled()
+	return nil
+}
+
+// cancelScheduled drops the pending scheduled change, NOT thread-safe
+func (r *Room) cancelScheduled() {
+	if r.scheduled == nil {
+		return
+	}
+	r.scheduled = nil
+	r.scheduleTimer.Stop()
+	r.BroadcastScheduled()
+}
+
+// applyScheduled applies the pending scheduled change once it is due, NOT thread-safe
+func (r *Room) applyScheduled() {
+	s := r.scheduled
+	if s == nil {
+		return
+	}
+	if wait := time.Until(s.at); wait > 0 {
+		// a stale tick from a timer that was rearmed
+		r.scheduleTimer.Reset(wait)
+		return
+	}
+	r.scheduled = nil
+	// clients started on their own at the scheduled time, so there is no
+	// latency to make up for
+	r.setState(s.state, s.state.Position, s.at)
+	r.finishUpdate(s.sender)
+}
+
+// scheduledMessage describes the pending scheduled change, NOT thread-safe
+func (r *Room) scheduledMessage() *Message {
+	p := &ScheduledUpdateMessage{}
+	if s := r.scheduled; s != nil {
+		p.State = s.state
+		p.At = timeToSeconds(s.at)
+		p.UpdatedBy = s.sender
+	}
+	return &Message{
+		Type:    MessageTypeScheduleUpdate,
+		Payload: p,
+	}
+}
+
+// BroadcastScheduled announces the pending scheduled change, or that there
+// is none, to every client in room r, NOT thread-safe
+func (r *Room) BroadcastScheduled() {
+	r.broadcast(r.scheduledMessage(), nil)
+}
+
+// SendScheduled tells client c about the pending scheduled change, NOT thread-safe
+func (r *Room) SendScheduled(c *ClientConn) {
+	if r.scheduled != nil {
+		r.send(c, r.scheduledMessage())
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+)
+
+// TokenSecretEnv is the environment variable holding the secret shared by
+// the scheduler and backends to sign room tokens
+const TokenSecretEnv = "VCHAMBER_TOKEN_SECRET"
+
+// DefaultSignedTokenTTL is the lifetime of signed tokens issued at room creation
+const DefaultSignedTokenTTL = 24 * time.Hour
+
+const maxSignedTokenTTL = 30 * 24 * time.Hour
+
+// the only header we issue and accept, HMAC-SHA256 in the compact JWT format
+var signedTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var (
+	errMalformedToken = errors.New("malformed signed token")
+	errBadSignature   = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("signed token expired")
+)
+
+// TokenClaims are the claims carried by a signed room token, a token is valid
+// on any backend serving its room until the key of its authority is rotated
+type TokenClaims struct {
+	ID        string `json:"jti"`
+	RoomID    string `json:"rid"`
+	Epoch     uint64 `json:"epoch,omitempty"`
+	Authority string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	Expires   int64  `json:"exp"`
+}
+
+// NewTokenClaims creates claims for a token granting authority in room rid for ttl
+func NewTokenClaims(rid string, authority string, ttl time.Duration) *TokenClaims {
+	now := time.Now()
+	return &TokenClaims{
+		ID:        xid.New().String(),
+		RoomID:    rid,
+		Authority: authority,
+		IssuedAt:  now.Unix(),
+		Expires:   now.Add(ttl).Unix(),
+	}
+}
+
+// TokenSigner signs and verifies stateless room tokens with a shared secret
+type TokenSigner struct {
+	secret []byte
+}
+
+// NewTokenSigner creates a signer with the given secret, it returns nil for an
+// empty secret so that signed tokens stay disabled
+func NewTokenSigner(secret string) *TokenSigner {
+	if secret == "" {
+		return nil
+	}
+	return &TokenSigner{secret: []byte(secret)}
+}
+
+// TokenSecretFromEnv returns secret if it is set, otherwise the value of TokenSecretEnv
+func TokenSecretFromEnv(secret string) string {
+	if secret != "" {
+		return secret
+	}
+	return os.Getenv(TokenSecretEnv)
+}
+
+// IsSignedToken reports whether token has the shape of a signed token, keys
+// from GenerateKey never contain dots
+func IsSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (s *TokenSigner) mac(signingInput string) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(signingInput))
+	return m.Sum(nil)
+}
+
+// Sign encodes and signs c
+func (s *TokenSigner) Sign(c *TokenClaims) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	in := signedTokenHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	return in + "." + base64.RawURLEncoding.EncodeToString(s.mac(in)), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims
+func (s *TokenSigner) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != signedTokenHeader {
+		return nil, errMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	if !hmac.Equal(sig, s.mac(parts[0]+"."+parts[1])) {
+		return nil, errBadSignature
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	var c TokenClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errMalformedToken
+	}
+	if time.Now().Unix() >= c.Expires {
+		return nil, errTokenExpired
+	}
+	return &c, nil
+}
+
+// SetTokenSigner enables signed room tokens on server s, it must be called
+// before s starts serving
+func (s *Server) SetTokenSigner(ts *TokenSigner) {
+	s.signer = ts
+}
+
+// newTokenClaims creates claims for a token granting authority in room r for ttl
+func (r *Room) newTokenClaims(authority string, ttl time.Duration) *TokenClaims {
+	c := NewTokenClaims(r.ID, authority, ttl)
+	r.tokenMutex.Lock()
+	c.Epoch = r.signEpochs[authority]
+	r.tokenMutex.Unlock()
+	return c
+}
+
+// verifySigned returns a token for the signed key if it is valid for room r,
+// or nil if it is not or signed tokens are disabled
+func (r *Room) verifySigned(key string) *RoomToken {
+	if r.server == nil || r.server.signer == nil {
+		return nil
+	}
+	c, err := r.server.signer.Verify(key)
+	if err != nil || c.RoomID != r.ID {
+		return nil
+	}
+	role := parseRole(c.Authority)
+	if role == clientStateUnauthorised {
+		return nil
+	}
+	t := &RoomToken{
+		ID:      c.ID,
+		Label:   "signed",
+		role:    role,
+		Expires: time.Unix(c.Expires, 0),
+		signed:  true,
+		epoch:   c.Epoch,
+	}
+	if !r.signedValid(t) {
+		return nil
+	}
+	return t
+}
+
+// signedValid reports whether the key of the authority of signed token t has
+// not been rotated since t was issued
+func (r *Room) signedValid(t *RoomToken) bool {
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	return r.signEpochs[t.role.String()] == t.epoch
+}
+
+// kickSigned disconnects every client of room r that joined with a signed
+// token granting role, NOT thread-safe
+func (r *Room) kickSigned(role clientState) {
+	for _, c := range r.clients {
+		if c.token != nil && c.token.signed && c.token.role == role {
+			r.killClientWithReason(c, websocket.ClosePolicyViolation, CloseReasonTokenRevoked)
+		}
+	}
+}
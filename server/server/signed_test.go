@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTokenSecret = "correct horse battery staple"
+
+// signTestToken signs claims for authority in room rid that expire after ttl
+func signTestToken(t *testing.T, s *TokenSigner, rid string, authority string, ttl time.Duration) string {
+	t.Helper()
+	token, err := s.Sign(NewTokenClaims(rid, authority, ttl))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return token
+}
+
+// replacePart replaces part i of the compact token with the base64 encoding of b
+func replacePart(token string, i int, b []byte) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString(b)
+	return strings.Join(parts, ".")
+}
+
+func TestTokenSignerVerify(t *testing.T) {
+	s := NewTokenSigner(testTokenSecret)
+	good := signTestToken(t, s, "party", "guest", time.Hour)
+	parts := strings.Split(good, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sig[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"good", good, nil},
+		{"expired", signTestToken(t, s, "party", "guest", -time.Second), errTokenExpired},
+		{"tampered payload", replacePart(good, 1, []byte(strings.Replace(string(payload), `"guest"`, `"master"`, 1))), errBadSignature},
+		{"tampered signature", replacePart(good, 2, sig), errBadSignature},
+		{"other secret", signTestToken(t, NewTokenSigner("another secret"), "party", "guest", time.Hour), errBadSignature},
+		{"unsigned header", replacePart(good, 0, []byte(`{"alg":"none","typ":"JWT"}`)), errMalformedToken},
+		{"missing signature", parts[0] + "." + parts[1], errMalformedToken},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!", errMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := s.Verify(tt.token)
+			if err != tt.err {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (c.RoomID != "party" || c.Authority != "guest") {
+				t.Fatalf("Verify() claims = %+v, want a guest of party", c)
+			}
+		})
+	}
+}
+
+func TestRoomVerifySigned(t *testing.T) {
+	s := NewTokenSigner(testTokenSecret)
+	r := NewRoom("party", &Server{signer: s}, "mkey", "gkey")
+	migrated := NewRoom("party", &Server{signer: s}, "other mkey", "other gkey")
+	guest := signTestToken(t, s, "party", "guest", time.Hour)
+
+	tests := []struct {
+		name  string
+		room  *Room
+		token string
+		role  clientState
+	}{
+		{"guest", r, guest, clientStateGuest},
+		{"master", r, signTestToken(t, s, "party", "master", time.Hour), clientStateMaster},
+		{"migrated room", migrated, guest, clientStateGuest},
+		{"wrong room", r, signTestToken(t, s, "other", "guest", time.Hour), clientStateUnauthorised},
+		{"unknown authority", r, signTestToken(t, s, "party", "admin", time.Hour), clientStateUnauthorised},
+		{"signer disabled", NewRoom("party", &Server{}, "mkey", "gkey"), guest, clientStateUnauthorised},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := clientStateUnauthorised
+			if tok := tt.room.verifySigned(tt.token); tok != nil {
+				role = tok.role
+			}
+			if role != tt.role {
+				t.Fatalf("verifySigned() role = %v, want %v", role, tt.role)
+			}
+		})
+	}
+
+	if _, _, err := r.RotateKeys(false, true); err != nil {
+		t.Fatalf("RotateKeys: %v", err)
+	}
+	if r.verifySigned(guest) != nil {
+		t.Fatal("guest token still valid after rotating the guest key")
+	}
+	fresh, err := s.Sign(r.newTokenClaims("guest", time.Hour))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if r.verifySigned(fresh) == nil {
+		t.Fatal("guest token issued after rotating the guest key is not valid")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// gains of the moving averages of the clock offset and its jitter, as used
+// by TCP for the round trip time
+const (
+	clockOffsetGain = 1.0 / 8.0
+	clockJitterGain = 1.0 / 4.0
+)
+
+// clockEstimate tracks the offset of a client's clock from the server clock,
+// only used by the client goroutine
+type clockEstimate struct {
+	offset  float64 // server clock minus client clock in seconds
+	jitter  float64 // mean deviation of the offset samples
+	samples int
+	lastT0  float64 // the previous exchange, completed by the next request
+	lastT1  float64
+}
+
+// add adds an offset sample from a complete exchange, t0 and t3 are read
+// from the client clock and t1 and t2 from the server clock
+func (e *clockEstimate) add(t0, t1, t2, t3 float64) (rtt float64, ok bool) {
+	rtt = (t3 - t0) - (t2 - t1)
+	if rtt < 0 || math.IsNaN(rtt) || math.IsInf(rtt, 0) {
+		return 0, false
+	}
+	sample := ((t1 - t0) + (t2 - t3)) / 2
+	if e.samples == 0 {
+		e.offset = sample
+	} else {
+		diff := sample - e.offset
+		e.offset += clockOffsetGain * diff
+		e.jitter += clockJitterGain * (math.Abs(diff) - e.jitter)
+	}
+	e.samples++
+	return rtt, true
+}
+
+// timeSync answers the time sync request m, it completes the previous
+// exchange with the client's receive time and folds it into the estimate
+func (c *ClientConn) timeSync(m *Message) *Message {
+	p := m.Payload.(*TimeSyncMessage)
+	t1 := timeToSeconds(m.ReceivedAt)
+	e := &c.clock
+	if p.PrevT0 != 0 && p.PrevT0 == e.lastT0 {
+		t2 := timeToSeconds(time.Unix(0, atomic.LoadInt64(&c.syncSent)))
+		if rtt, ok := e.add(e.lastT0, e.lastT1, t2, p.PrevT3); ok {
+			c.setLatency(rtt)
+		}
+	}
+	e.lastT0 = p.T0
+	e.lastT1 = t1
+	return &Message{
+		Type: MessageTypeTimeSync,
+		Payload: &TimeSyncMessage{
+			T0:     p.T0,
+			T1:     t1,
+			Offset: e.offset,
+			Jitter: e.jitter,
+		},
+	}
+}
+
+// stampTimeSync sets the server send time of a time sync reply right before
+// it is written, called by the writer goroutine
+func (c *ClientConn) stampTimeSync(p *TimeSyncMessage) {
+	now := time.Now()
+	p.T2 = timeToSeconds(now)
+	atomic.StoreInt64(&c.syncSent, now.UnixNano())
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+)
+
+// IDs of the tokens every room is created with
+const (
+	MasterTokenID = "master"
+	GuestTokenID  = "guest"
+)
+
+const (
+	maxRoomTokens   = 256
+	maxTokenLabelSz = 64
+	tokenSaltLength = 16
+)
+
+// RoomToken is an invite token granting a role in a room, only a salted hash
+// of its key is kept
+type RoomToken struct {
+	ID      string
+	Label   string
+	role    clientState
+	salt    []byte
+	hash    []byte
+	Expires time.Time // zero for tokens that never expire
+	MaxUses int       // zero for unlimited uses
+	Uses    int
+	signed  bool   // a stateless signed token, never stored in the room
+	epoch   uint64 // the signing epoch of a signed token
+}
+
+// TokenInfo describes a room token, Token is only set when it has just been minted
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	Authority string     `json:"authority"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	MaxUses   int        `json:"maxUses,omitempty"`
+	Uses      int        `json:"uses"`
+	Token     string     `json:"token,omitempty"`
+}
+
+func (t *RoomToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+func (t *RoomToken) exhausted() bool {
+	return t.MaxUses > 0 && t.Uses >= t.MaxUses
+}
+
+// shared reports whether t is handed out to everyone with the room link
+// rather than to a single person
+func (t *RoomToken) shared() bool {
+	return t.signed || t.ID == MasterTokenID || t.ID == GuestTokenID
+}
+
+func (t *RoomToken) info() *TokenInfo {
+	i := &TokenInfo{
+		ID:        t.ID,
+		Label:     t.Label,
+		Authority: t.role.String(),
+		MaxUses:   t.MaxUses,
+		Uses:      t.Uses,
+	}
+	if !t.Expires.IsZero() {
+		e := t.Expires
+		i.Expires = &e
+	}
+	return i
+}
+
+func hashKey(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// newRoomToken creates a token with the given key, hashed with a fresh salt
+func newRoomToken(id string, label string, role clientState, key string) (*RoomToken, error) {
+	salt := make([]byte, tokenSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &RoomToken{
+		ID:    id,
+		Label: label,
+		role:  role,
+		salt:  salt,
+		hash:  hashKey(salt, key),
+	}, nil
+}
+
+// matches compares key against t in constant time
+func (t *RoomToken) matches(key string) bool {
+	return subtle.ConstantTimeCompare(hashKey(t.salt, key), t.hash) == 1
+}
+
+func newBuiltinToken(id string, role clientState, key string) *RoomToken {
+	t, err := newRoomToken(id, id, role, key)
+	if err != nil {
+		// crypto/rand is asserted to work when the server is created
+		panic(err)
+	}
+	return t
+}
+
+func newBuiltinTokens(mKey string, gKey string) map[string]*RoomToken {
+	return map[string]*RoomToken{
+		MasterTokenID: newBuiltinToken(MasterTokenID, clientStateMaster, mKey),
+		GuestTokenID:  newBuiltinToken(GuestTokenID, clientStateGuest, gKey),
+	}
+}
+
+// parseRole converts an authority string to a client state
+func parseRole(authority string) clientState {
+	switch authority {
+	case clientStateMaster.String():
+		return clientStateMaster
+	case clientStateGuest.String():
+		return clientStateGuest
+	default:
+		return clientStateUnauthorised
+	}
+}
+
+// lookupToken returns the usable token matching key and prunes expired
+// tokens, every token is compared so the time taken does not depend on which
+// one matches, r.tokenMutex must be held
+func (r *Room) lookupToken(key string) *RoomToken {
+	now := time.Now()
+	var found *RoomToken
+	for id, t := range r.tokens {
+		if t.expired(now) {
+			delete(r.tokens, id)
+			continue
+		}
+		if t.matches(key) && key != "" && !t.exhausted() {
+			found = t
+		}
+	}
+	return found
+}
+
+// authorise returns the client state granted by key in room r without
+// consuming a use of the token
+func (r *Room) authorise(key string) clientState {
+	if t := r.findToken(key); t != nil {
+		return t.role
+	}
+	return clientStateUnauthorised
+}
+
+// findToken returns a copy of the token matching key without consuming one of
+// its uses, it returns nil if key does not grant access to room r
+func (r *Room) findToken(key string) *RoomToken {
+	if IsSignedToken(key) {
+		return r.verifySigned(key)
+	}
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	t := r.lookupToken(key)
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// redeemToken consumes one of the uses of t, a copy returned by findToken, it
+// returns false if t has been revoked, rotated, has expired or was used up
+// since it was found
+func (r *Room) redeemToken(t *RoomToken) bool {
+	if t.signed {
+		return r.signedValid(t)
+	}
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	cur, ok := r.tokens[t.ID]
+	if !ok || !bytes.Equal(cur.hash, t.hash) || cur.expired(time.Now()) || cur.exhausted() {
+		return false
+	}
+	cur.Uses++
+	return true
+}
+
+// CheckMasterKey verifies key with the room's master key
+func (r *Room) CheckMasterKey(key string) bool {
+	return r.authorise(key) == clientStateMaster
+}
+
+// CheckGuestKey verifies key with the room's guest key
+func (r *Room) CheckGuestKey(key string) bool {
+	return r.authorise(key) == clientStateGuest
+}
+
+// RotateKeys replaces the built-in master and/or guest token of room r with
+// fresh random keys and returns the new keys, empty for tokens not rotated,
+// signed tokens granting a rotated authority stop being accepted
+func (r *Room) RotateKeys(master bool, guest bool) (string, string, error) {
+	mKey, e1 := GenerateKey(keyLength)
+	gKey, e2 := GenerateKey(keyLength)
+	if e1 != nil {
+		return "", "", e1
+	}
+	if e2 != nil {
+		return "", "", e2
+	}
+	fresh := newBuiltinTokens(mKey, gKey)
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	if master {
+		r.tokens[MasterTokenID] = fresh[MasterTokenID]
+		r.signEpochs[clientStateMaster.String()]++
+	} else {
+		mKey = ""
+	}
+	if guest {
+		r.tokens[GuestTokenID] = fresh[GuestTokenID]
+		r.signEpochs[clientStateGuest.String()]++
+	} else {
+		gKey = ""
+	}
+	return mKey, gKey, nil
+}
+
+// MintToken creates a new invite token in room r and returns its description,
+// this is the only time the key is revealed
+func (r *Room) MintToken(label string, authority string, expires time.Time, maxUses int) (*TokenInfo, error) {
+	role := parseRole(authority)
+	if role == clientStateUnauthorised {
+		return nil, errors.New("authority must be master or guest")
+	}
+	if len(label) > maxTokenLabelSz {
+		return nil, errors.New("label is too long")
+	}
+	if maxUses < 0 {
+		return nil, errors.New("maxUses must not be negative")
+	}
+	if !expires.IsZero() && expires.Before(time.Now()) {
+		return nil, errors.New("expiry is in the past")
+	}
+	key, err := GenerateKey(keyLength)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newRoomToken(xid.New().String(), label, role, key)
+	if err != nil {
+		return nil, err
+	}
+	t.Expires = expires
+	t.MaxUses = maxUses
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	r.lookupToken("") // prune expired tokens
+	if len(r.tokens) >= maxRoomTokens {
+		return nil, errors.New("too many tokens in this room")
+	}
+	r.tokens[t.ID] = t
+	i := t.info()
+	i.Token = key
+	return i, nil
+}
+
+// ListTokens returns the descriptions of all live tokens in room r
+func (r *Room) ListTokens() []*TokenInfo {
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	r.lookupToken("") // prune expired tokens
+	ts := make([]*TokenInfo, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		ts = append(ts, t.info())
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].ID < ts[j].ID })
+	return ts
+}
+
+// RevokeToken removes the token with the given ID from room r, it returns
+// false if there is no such token
+func (r *Room) RevokeToken(id string) bool {
+	r.tokenMutex.Lock()
+	defer r.tokenMutex.Unlock()
+	if _, ok := r.tokens[id]; !ok {
+		return false
+	}
+	delete(r.tokens, id)
+	return true
+}
+
+// kickByToken disconnects every client of room r that joined with one of the
+// given tokens, NOT thread-safe
+func (r *Room) kickByToken(ids ...string) {
+	for _, c := range r.clients {
+		for _, id := range ids {
+			if c.tokenID == id {
+				r.killClientWithReason(c, websocket.ClosePolicyViolation, CloseReasonTokenRevoked)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// TrackOff selects no track, e.g. to turn subtitles off
+const TrackOff = "off"
+
+const (
+	maxTracks           = 64 // of each kind
+	maxTrackIDLength    = 64
+	maxTrackLabelLength = 100 // in runes
+)
+
+func hasTrack(tracks []*MediaTrack, id string) bool {
+	for _, t := range tracks {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// validSelection reports whether id selects one of tracks, no track or the default
+func validSelection(tracks []*MediaTrack, id string) bool {
+	return id == "" || id == TrackOff || hasTrack(tracks, id)
+}
+
+func validateTrackList(tracks []*MediaTrack) ([]*MediaTrack, error) {
+	if len(tracks) > maxTracks {
+		return nil, errors.New("too many tracks")
+	}
+	l := make([]*MediaTrack, 0, len(tracks))
+	for _, t := range tracks {
+		if t == nil {
+			return nil, errors.New("empty track")
+		}
+		id := strings.TrimSpace(t.ID)
+		if id == "" || id == TrackOff || len(id) > maxTrackIDLength || hasTrack(l, id) {
+			return nil, errors.New("invalid track ID")
+		}
+		label := strings.TrimSpace(t.Label)
+		lang := strings.TrimSpace(t.Language)
+		if !utf8.ValidString(label) || utf8.RuneCountInString(label) > maxTrackLabelLength ||
+			!utf8.ValidString(lang) || len(lang) > maxTrackIDLength {
+			return nil, errors.New("invalid track label")
+		}
+		l = append(l, &MediaTrack{ID: id, Label: label, Language: lang})
+	}
+	return l, nil
+}
+
+// validateTracks checks the tracks of a state update and returns a copy of them
+func validateTracks(t *TrackState) (*TrackState, error) {
+	subtitles, err := validateTrackList(t.Subtitles)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := validateTrackList(t.Audio)
+	if err != nil {
+		return nil, err
+	}
+	if !validSelection(subtitles, t.Subtitle) || !validSelection(audio, t.AudioTrack) {
+		return nil, errors.New("selected track does not exist")
+	}
+	return &TrackState{
+		Subtitles:  subtitles,
+		Audio:      audio,
+		Subtitle:   t.Subtitle,
+		AudioTrack: t.AudioTrack,
+	}, nil
+}
+
+// updateTracks replaces the tracks of the room, updates without tracks keep
+// the current ones, NOT thread-safe
+func (r *Room) updateTracks(t *TrackState) {
+	if t == nil {
+		return
+	}
+	tracks, err := validateTracks(t)
+	if err != nil {
+		log.Printf("ignored invalid tracks in room %s: %v", r.ID, err)
+		return
+	}
+	r.state.tracks = tracks
+	for _, c := range r.clients {
+		r.checkTrackOverride(c)
+	}
+}
+
+// checkTrackOverride drops the overrides of client c that no longer match a
+// track, NOT thread-safe
+func (r *Room) checkTrackOverride(c *ClientConn) {
+	o := c.tracks
+	if o == nil {
+		return
+	}
+	var subtitles, audio []*MediaTrack
+	if r.state.tracks != nil {
+		subtitles, audio = r.state.tracks.Subtitles, r.state.tracks.Audio
+	}
+	n := &TrackOverrideMessage{Subtitle: o.Subtitle, AudioTrack: o.AudioTrack}
+	if !validSelection(subtitles, n.Subtitle) {
+		n.Subtitle = ""
+	}
+	if !validSelection(audio, n.AudioTrack) {
+		n.AudioTrack = ""
+	}
+	if n.Subtitle == "" && n.AudioTrack == "" {
+		n = nil
+	}
+	c.tracks = n
+}
+
+// setTrackOverride sets the tracks client c plays instead of the ones the
+// room selected, empty selections follow the room, NOT thread-safe
+func (r *Room) setTrackOverride(c *ClientConn, p *TrackOverrideMessage) {
+	c.tracks = &TrackOverrideMessage{
+		Subtitle:   strings.TrimSpace(p.Subtitle),
+		AudioTrack: strings.TrimSpace(p.AudioTrack),
+	}
+	r.checkTrackOverride(c)
+	r.send(c, r.stateMessageFor(c, r.GetCurrentStateMessage()))
+}
+
+// stateMessageFor returns the state message m with the track overrides of
+// client c added, m is shared between clients and left untouched, NOT thread-safe
+func (r *Room) stateMessageFor(c *ClientConn, m *Message) *Message {
+	if c.tracks == nil {
+		return m
+	}
+	p := *m.Payload.(*PlaybackStateMessage)
+	p.Override = c.tracks
+	return &Message{
+		Type:    m.Type,
+		Payload: &p,
+	}
+}
+
+// resetSource forgets everything tied to the previous source of the room, NOT thread-safe
+func (r *Room) resetSource() {
+	r.reactions = make(reactionTimeline)
+	r.state.tracks = nil
+	for _, c := range r.clients {
+		c.tracks = nil
+	}
+}
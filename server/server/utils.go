@@ -5,6 +5,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"math"
+	"time"
 )
 
 func assertCryptoPRNG() {
@@ -25,3 +27,23 @@ func GenerateKey(n int) (string, error) {
 	return base64.URLEncoding.EncodeToString(buf), nil
 
 }
+
+// secondsToTime converts seconds since the epoch, as used by the protocol, to a time
+func secondsToTime(s float64) time.Time {
+	return time.Unix(0, int64(s*1e9))
+}
+
+// isFinite reports whether none of xs is NaN or infinite
+func isFinite(xs ...float64) bool {
+	for _, x := range xs {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// timeToSeconds converts t to seconds since the epoch
+func timeToSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
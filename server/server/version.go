@@ -0,0 +1,62 @@
+package server
+
+import "log"
+
+// Conflict policy for state updates from concurrent masters
+//
+// Every change to the source, status, position or speed of a room bumps the
+// version of its state, which is sent with every state broadcast. A state
+// update names the version it is based on in BaseVersion and is resolved as
+// follows:
+//
+//  - BaseVersion 0 comes from clients that predate versioning, the last
+//    writer wins as it always did
+//  - an update based on the current version is applied, as is one based on
+//    the version before the sender's own update, which it may not have
+//    received yet
+//  - a stale update that pauses or stops the current source is merged, pausing
+//    always wins but playback stops at the current position of the room so
+//    that a seek the sender had not seen yet is kept
+//  - any other stale update, or one based on a version that does not exist
+//    yet, is rejected and its sender gets a Conflict message with the current
+//    state to rebase on
+
+// bumpVersion marks a change to the playback state of the room, NOT thread-safe
+func (r *Room) bumpVersion() {
+	r.state.version++
+}
+
+// resolveUpdate applies the conflict policy to the state update in m, it
+// returns false if the update is rejected, NOT thread-safe
+func (r *Room) resolveUpdate(m *Message) bool {
+	p := m.Payload.(*PlaybackStateUpdateMessage)
+	st := r.state
+	if p.BaseVersion == 0 || p.BaseVersion == st.version {
+		return true
+	}
+	if p.BaseVersion+1 == st.version && st.updatedBy == m.Sender {
+		return true
+	}
+	if p.BaseVersion < st.version && p.State.Source == st.source &&
+		(p.State.Status == PlaybackStatusPaused || p.State.Status == PlaybackStatusStopped) {
+		merged := *p.State
+		merged.Position = r.currentPosition()
+		merged.Speed = st.speed
+		merged.Duration = st.duration
+		merged.Tracks = nil // keep the current tracks
+		p.State = &merged
+		return true
+	}
+	log.Printf("rejected state update from %s based on version %d, room %s is at %d",
+		m.Sender, p.BaseVersion, r.ID, st.version)
+	if c, ok := r.clients[m.Sender]; ok {
+		r.send(c, &Message{
+			Type: MessageTypeConflict,
+			Payload: &ConflictMessage{
+				BaseVersion: p.BaseVersion,
+				State:       r.stateMessageFor(c, r.GetCurrentStateMessage()).Payload.(*PlaybackStateMessage),
+			},
+		})
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol v2 differs from v1 only on the wire: message types are strings
+// rather than integers and clients exchange capabilities in Hello, every
+// message inside the server uses the same Message struct either way. v2 is
+// spoken in JSON or MessagePack depending on the subprotocol
+
+// protocol versions spoken by clients
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+// messageTypeUnknown marks a message whose type could not be decoded
+const messageTypeUnknown MessageType = -1
+
+var messageTypeNames = map[MessageType]string{
+	MessageTypeHello:            "hello",
+	MessageTypePing:             "ping",
+	MessageTypePong:             "pong",
+	MessageTypeStateBroadcast:   "state",
+	MessageTypeStateUpdate:      "state_update",
+	MessageTypePromote:          "promote",
+	MessageTypeDemote:           "demote",
+	MessageTypeKick:             "kick",
+	MessageTypeRoster:           "roster",
+	MessageTypePresence:         "presence",
+	MessageTypeChat:             "chat",
+	MessageTypeChatHistory:      "chat_history",
+	MessageTypeReaction:         "reaction",
+	MessageTypeReactionTimeline: "reaction_timeline",
+	MessageTypeEnqueue:          "enqueue",
+	MessageTypeDequeue:          "dequeue",
+	MessageTypeMoveItem:         "move_item",
+	MessageTypeSkip:             "skip",
+	MessageTypeSetMode:          "set_mode",
+	MessageTypeTrackOverride:    "track_override",
+	MessageTypeBuffering:        "buffering",
+	MessageTypeBufferingWait:    "buffering_wait",
+	MessageTypeScheduleUpdate:   "schedule_update",
+	MessageTypeTimeSync:         "time_sync",
+	MessageTypeConflict:         "conflict",
+	MessageTypeError:            "error",
+	MessageTypeAck:              "ack",
+	MessageTypeReserved:         "reserved",
+}
+
+var messageTypesByName = func() map[string]MessageType {
+	m := make(map[string]MessageType, len(messageTypeNames))
+	for t, name := range messageTypeNames {
+		m[name] = t
+	}
+	return m
+}()
+
+// String returns the v2 name of t
+func (t MessageType) String() string {
+	return messageTypeNames[t]
+}
+
+// optional features a v2 client may leave out of its capabilities to stop
+// receiving the messages that belong to them
+const (
+	CapabilityChat      = "chat"
+	CapabilityReactions = "reactions"
+	CapabilityPresence  = "presence"
+	CapabilitySchedule  = "schedule"
+	CapabilityTimeSync  = "timesync"
+	CapabilityAcks      = "acks"
+)
+
+// ServerCapabilities lists the optional features this server supports
+var ServerCapabilities = []string{
+	CapabilityChat,
+	CapabilityReactions,
+	CapabilityPresence,
+	CapabilitySchedule,
+	CapabilityTimeSync,
+	CapabilityAcks,
+}
+
+var capabilityOf = map[MessageType]string{
+	MessageTypeChat:             CapabilityChat,
+	MessageTypeChatHistory:      CapabilityChat,
+	MessageTypeReaction:         CapabilityReactions,
+	MessageTypeReactionTimeline: CapabilityReactions,
+	MessageTypeRoster:           CapabilityPresence,
+	MessageTypePresence:         CapabilityPresence,
+	MessageTypeScheduleUpdate:   CapabilitySchedule,
+	MessageTypeTimeSync:         CapabilityTimeSync,
+	MessageTypeAck:              CapabilityAcks,
+}
+
+type wireMessageV2 struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+type receivedMessageV2 struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// errorMessageV2 is ErrorMessage with the type of the request as a name
+type errorMessageV2 struct {
+	Code        string `json:"code"`
+	Message     string `json:"message,omitempty"`
+	RequestID   string `json:"requestID,omitempty"`
+	RequestType string `json:"requestType,omitempty"`
+}
+
+// wireV2 converts m to its v2 envelope
+func (m *Message) wireV2() *wireMessageV2 {
+	payload := m.Payload
+	if p, ok := payload.(*ErrorMessage); ok {
+		e := &errorMessageV2{
+			Code:      p.Code,
+			Message:   p.Message,
+			RequestID: p.RequestID,
+		}
+		if p.RequestType != nil {
+			e.RequestType = p.RequestType.String()
+		}
+		payload = e
+	}
+	return &wireMessageV2{
+		ID:      m.ID,
+		Type:    m.Type.String(),
+		Payload: payload,
+	}
+}
+
+// SerialiseV2 serialises m to the v2 wire format
+func (m *Message) SerialiseV2() ([]byte, error) {
+	return json.Marshal(m.wireV2())
+}
+
+// DeserialiseV2 decodes a message in the v2 wire format in data into m
+func DeserialiseV2(data []byte, m *Message) error {
+	var rm receivedMessageV2
+	if err := json.Unmarshal(data, &rm); err != nil {
+		return err
+	}
+	m.ReceivedAt = time.Now()
+	m.ID = rm.ID
+	t, ok := messageTypesByName[rm.Type]
+	if !ok {
+		m.Type = messageTypeUnknown
+		return errUnknownMessageType
+	}
+	m.Type = t
+	return decodePayload(m, rm.Payload, func(v interface{}) error {
+		return json.Unmarshal(rm.Payload, v)
+	})
+}
+
+// WireFormat is the encoding of messages on a websocket, it is chosen by the
+// subprotocol
+type WireFormat int
+
+// WireFormat enum instances
+const (
+	WireJSONV1    WireFormat = iota // vchamber_v1
+	WireJSONV2                      // vchamber_v2
+	WireMsgPackV2                   // vchamber_v2.msgpack
+	numWireFormats
+)
+
+// WireFormatOf returns the wire format of a websocket subprotocol, it returns
+// false if the subprotocol is not supported
+func WireFormatOf(subprotocol string) (WireFormat, bool) {
+	switch subprotocol {
+	case WebsocketSubprotocolMagicV1:
+		return WireJSONV1, true
+	case WebsocketSubprotocolMagicV2:
+		return WireJSONV2, true
+	case WebsocketSubprotocolMagicV2MsgPack:
+		return WireMsgPackV2, true
+	default:
+		return WireJSONV1, false
+	}
+}
+
+// Protocol returns the protocol version spoken in wire format f
+func (f WireFormat) Protocol() int {
+	if f == WireJSONV1 {
+		return ProtocolV1
+	}
+	return ProtocolV2
+}
+
+// FrameType returns the websocket message type used by wire format f
+func (f WireFormat) FrameType() int {
+	if f == WireMsgPackV2 {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// SerialiseFor serialises m in wire format f
+func (m *Message) SerialiseFor(f WireFormat) ([]byte, error) {
+	switch f {
+	case WireJSONV2:
+		return m.SerialiseV2()
+	case WireMsgPackV2:
+		return m.SerialiseMsgPack()
+	default:
+		return m.Serialise()
+	}
+}
+
+// Encode is SerialiseFor with the result cached in m, so that a message
+// broadcast to many clients is serialised once per wire format, m must not
+// be modified after it was first encoded
+func (m *Message) Encode(f WireFormat) ([]byte, error) {
+	m.encMutex.Lock()
+	defer m.encMutex.Unlock()
+	if b := m.encoded[f]; b != nil {
+		return b, nil
+	}
+	b, err := m.SerialiseFor(f)
+	if err != nil {
+		return nil, err
+	}
+	m.encoded[f] = b
+	return b, nil
+}
+
+// DeserialiseFrom decodes a message in wire format f in data into m
+func DeserialiseFrom(f WireFormat, data []byte, m *Message) error {
+	switch f {
+	case WireJSONV2:
+		return DeserialiseV2(data, m)
+	case WireMsgPackV2:
+		return DeserialiseMsgPack(data, m)
+	default:
+		return Deserialise(data, m)
+	}
+}
+
+// setCapabilities records the optional features a v2 client supports, called
+// from the client goroutine
+func (c *ClientConn) setCapabilities(caps []string) {
+	set := make(map[string]bool, len(caps))
+	for _, feature := range caps {
+		set[feature] = true
+	}
+	c.capabilities.Store(set)
+}
+
+// wants reports whether c should be sent m, v1 clients and v2 clients that
+// have not declared capabilities get everything, called from the writer goroutine
+func (c *ClientConn) wants(m *Message) bool {
+	if c.protocol != ProtocolV2 {
+		return true
+	}
+	feature, ok := capabilityOf[m.Type]
+	if !ok {
+		return true
+	}
+	set, ok := c.capabilities.Load().(map[string]bool)
+	return !ok || set[feature]
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// clients a broadcast is sent to in the broadcast benchmarks
+const benchClients = 100
+
+var wireFormats = []struct {
+	name   string
+	format WireFormat
+}{
+	{"json_v1", WireJSONV1},
+	{"json_v2", WireJSONV2},
+	{"msgpack_v2", WireMsgPackV2},
+}
+
+// benchStateBroadcast returns a state broadcast with a queue of 20 items like
+// the ones sent by the room manager every update interval
+func benchStateBroadcast() *Message {
+	queue := make([]*MediaItem, 20)
+	for i := range queue {
+		queue[i] = &MediaItem{
+			ID:       fmt.Sprintf("bmv1i5c2qf0ofkn9k0%02d", i),
+			Source:   fmt.Sprintf("https://example.com/media/%d.mp4", i),
+			Title:    fmt.Sprintf("Episode %d", i),
+			Duration: 1440,
+		}
+	}
+	return &Message{
+		Type: MessageTypeStateBroadcast,
+		Payload: &PlaybackStateMessage{
+			Source:        queue[0].Source,
+			Status:        PlaybackStatusPlaying,
+			Position:      321.5,
+			ServerTime:    timeToSeconds(time.Now()),
+			Speed:         1,
+			Duration:      1440,
+			Version:       42,
+			UpdatedBy:     "bmv1i5c2qf0ofkn9k0ag",
+			UpdatedByName: "master",
+			Queue:         queue,
+		},
+	}
+}
+
+// asGeneric decodes data into the generic values encoding/json produces, so
+// that messages in different wire formats can be compared
+func asGeneric(t *testing.T, format WireFormat, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if format == WireMsgPackV2 {
+		if err := msgpack.Unmarshal(data, &v); err != nil {
+			t.Fatalf("msgpack.Unmarshal: %v", err)
+		}
+		// numbers decode to the smallest fitting type
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		data = b
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return v
+}
+
+func TestMsgPackMatchesJSONV2(t *testing.T) {
+	name := ""
+	reqType := MessageTypeChat
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"state", benchStateBroadcast()},
+		{"empty state", &Message{Type: MessageTypeStateBroadcast, Payload: &PlaybackStateMessage{}}},
+		{"hello", &Message{Type: MessageTypeHello, Payload: &HelloMessage{
+			ClientType: "guest", ClientID: "c1", Name: &name, Protocol: ProtocolV2, Capabilities: ServerCapabilities,
+		}}},
+		{"roster", &Message{Type: MessageTypeRoster, Payload: &RosterMessage{
+			Clients: []*RosterEntry{{ClientID: "c1", Authority: "master", Latency: 0.02}, {ClientID: "c2", Name: "guest"}},
+		}}},
+		{"chat history", &Message{Type: MessageTypeChatHistory, Payload: &ChatHistoryMessage{
+			Messages: []*ChatMessage{{ClientID: "c1", Text: "hi", Timestamp: 1.5}},
+		}}},
+		{"error", errorMessage(&Message{ID: "r1", Type: reqType}, ErrCodeInvalid, "invalid chat message")},
+		{"ack", &Message{ID: "a1", Type: MessageTypeAck, Payload: &AckMessage{RequestID: "r1", Result: AckApplied, Version: 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := tt.msg.SerialiseFor(WireJSONV2)
+			if err != nil {
+				t.Fatalf("SerialiseFor(json): %v", err)
+			}
+			m, err := tt.msg.SerialiseFor(WireMsgPackV2)
+			if err != nil {
+				t.Fatalf("SerialiseFor(msgpack): %v", err)
+			}
+			want := asGeneric(t, WireJSONV2, j)
+			if got := asGeneric(t, WireMsgPackV2, m); !reflect.DeepEqual(got, want) {
+				t.Fatalf("msgpack message\n%v\nwant the same as json\n%v", got, want)
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastPerClient serialises a broadcast once for every client
+func BenchmarkBroadcastPerClient(b *testing.B) {
+	for _, f := range wireFormats {
+		b.Run(f.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := benchStateBroadcast()
+				for c := 0; c < benchClients; c++ {
+					if _, err := m.SerialiseFor(f.format); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastEncoded encodes a broadcast once per wire format for
+// clients spread evenly over the formats, as the client writers do
+func BenchmarkBroadcastEncoded(b *testing.B) {
+	cases := []struct {
+		name    string
+		formats []WireFormat
+	}{
+		{"json_v1", []WireFormat{WireJSONV1}},
+		{"msgpack_v2", []WireFormat{WireMsgPackV2}},
+		{"mixed", []WireFormat{WireJSONV1, WireJSONV2, WireMsgPackV2}},
+	}
+	for _, bc := range cases {
+		formats := bc.formats
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := benchStateBroadcast()
+				for c := 0; c < benchClients; c++ {
+					if _, err := m.Encode(formats[c%len(formats)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeserialise decodes a state update from a client
+func BenchmarkDeserialise(b *testing.B) {
+	for _, f := range wireFormats {
+		m := benchStateBroadcast()
+		m.Type = MessageTypeStateUpdate
+		m.Payload = &PlaybackStateUpdateMessage{
+			State: m.Payload.(*PlaybackStateMessage),
+			RTT:   0.05,
+		}
+		data, err := m.SerialiseFor(f.format)
+		if err != nil {
+			b.Fatal(err)
+		}
+		format := f.format
+		b.Run(f.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var msg Message
+				if err := DeserialiseFrom(format, data, &msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,8 +15,23 @@ import (
 
 const (
 	WebsocketSubprotocolMagicV1 = "vchamber_v1"
+	WebsocketSubprotocolMagicV2 = "vchamber_v2"
 	ErrInvalidRoomID            = "Error: Invalid Room ID"
 	ErrInvalidToken             = "Error: Invalid token"
+	ErrRoomIDTaken              = "Error: Room ID already in use"
+	ErrBanned                   = "Error: Banned from room"
+)
+
+// WebsocketSubprotocolMagicV2MsgPack is protocol v2 encoded in MessagePack
+const WebsocketSubprotocolMagicV2MsgPack = "vchamber_v2.msgpack"
+
+// reasons sent to clients in the websocket close frame
+const (
+	CloseReasonRoomDestroyed  = "room destroyed"
+	CloseReasonRoomExpired    = "room expired"
+	CloseReasonServerShutdown = "server shutting down"
+	CloseReasonTokenRevoked   = "token revoked"
+	CloseReasonKicked         = "kicked"
 )
 
 const (
@@ -36,29 +53,78 @@ const (
 	updateCooldown           = 1 * time.Second
 )
 
+// RoomOptions holds the per-room timing parameters used by the room manager
+type RoomOptions struct {
+	MasterlessTimeout time.Duration // how long a room lives without masters
+	BroadcastPeriod   time.Duration // how often the state is broadcast
+	UpdateCooldown    time.Duration // minimum interval between state updates
+	WaitForBuffering  bool          // pause playback while clients are buffering
+	BufferingFraction float64       // fraction of clients that must be buffering, 0 for any
+}
+
+// DefaultRoomOptions returns the options used by rooms created without
+// explicit configuration
+func DefaultRoomOptions() RoomOptions {
+	return RoomOptions{
+		MasterlessTimeout: defaultMasterlessTimeout,
+		BroadcastPeriod:   broadcastPeriod,
+		UpdateCooldown:    updateCooldown,
+	}
+}
+
 // Server encapsulates server-level global data
 type Server struct {
 	rooms        map[string]*Room // a map of rooms
-	enqRoom      chan *Room
+	enqRoom      chan *roomRegistration
 	deqRoom      chan *Room
 	closing      chan bool
 	closingGuard sync.Once
-	mutex        sync.RWMutex // guard rooms for look up
+	mutex        sync.RWMutex    // guard rooms for look up
+	signer       *TokenSigner    // nil unless signed tokens are enabled
+	proxies      *TrustedProxies // nil unless the server runs behind reverse proxies
+	upgrader     *websocket.Upgrader
 }
 
 // Room encapsulates room-level global data and manages users in a room
 type Room struct {
-	ID        string
-	clients   map[string]*ClientConn // a map with id:client kv pairs
-	masters   map[string]*ClientConn
-	recvQueue chan *Message // deserialise early in parallel in separate goroutines
-	enqClient chan *ClientConn
-	deqClient chan *ClientConn
-	closing   chan bool
-	masterKey string
-	guestKey  string
-	state     *PlaybackState
-	server    *Server
+	ID            string
+	clients       map[string]*ClientConn // a map with id:client kv pairs
+	masters       map[string]*ClientConn
+	recvQueue     chan *Message // deserialise early in parallel in separate goroutines
+	enqClient     chan *ClientConn
+	deqClient     chan *ClientConn
+	control       chan func() // closures to run in the room manager
+	closing       chan bool
+	closingGuard  sync.Once
+	closeReason   string     // written once before closing is closed
+	tokenMutex    sync.Mutex // guard tokens, bans and signEpochs
+	tokens        map[string]*RoomToken
+	bans          map[string]bool
+	signEpochs    map[string]uint64 // per authority, bumped to invalidate signed tokens
+	chat          *chatRing
+	reactions     reactionTimeline // reactions to the current source
+	state         *PlaybackState
+	opts          RoomOptions
+	shutdownTimer *time.Timer // running while the room has no masters
+	endTimer      *time.Timer // running until the current item ends
+	queue         []*MediaItem
+	current       *MediaItem // the item last taken from the queue
+	held          bool       // paused by the buffering barrier
+	scheduled     *scheduledUpdate
+	scheduleTimer *time.Timer // running until the scheduled change is due
+	server        *Server
+	createdAt     time.Time
+}
+
+// roomRegistration is a request to register a room with the server,
+// the outcome is sent back on result
+type roomRegistration struct {
+	room   *Room
+	result chan error
+}
+
+func newRoomRegistration(r *Room) *roomRegistration {
+	return &roomRegistration{r, make(chan error, 1)}
 }
 
 type clientState int
@@ -69,71 +135,135 @@ const (
 	clientStateMaster
 )
 
+func (s clientState) String() string {
+	switch s {
+	case clientStateMaster:
+		return "master"
+	case clientStateGuest:
+		return "guest"
+	default:
+		return ""
+	}
+}
+
 // ClientConn encapsulates an established client websocket connection
 type ClientConn struct {
-	ID        string
-	conn      *websocket.Conn
-	recvQueue chan *Message
-	sendQueue chan *Message
-	closing   chan bool
-	state     clientState
-	room      *Room
+	latency      int64 // the last reported round trip time, accessed atomically
+	syncSent     int64 // when the last time sync reply was written, accessed atomically
+	ID           string
+	conn         *websocket.Conn
+	recvQueue    chan *Message
+	sendQueue    chan *Message
+	closing      chan bool
+	closeCode    int    // written once before closing is closed
+	closeReason  string // written once before closing is closed
+	state        clientState
+	tokenID      string                // the ID of the token the client joined with
+	token        *RoomToken            // the token the client joined with, redeemed when it joins the room
+	addr         string                // the address the client connected from, empty if only a proxy's is known
+	name         string                // the display name chosen by the client
+	avatar       string                // a colour or emoji chosen by the client
+	reactions    *rateLimiter          // only used by the client goroutine
+	chats        *rateLimiter          // only used by the client goroutine
+	stalls       *rateLimiter          // only used by the client goroutine
+	tracks       *TrackOverrideMessage // only used by the room manager
+	buffering    bool                  // only used by the room manager
+	clock        clockEstimate
+	format       WireFormat   // the encoding of messages to and from the client
+	protocol     int          // the protocol version spoken by the client
+	capabilities atomic.Value // map[string]bool of features declared by a v2 client
+	room         *Room
 }
 
-var wsUpgrader = GetWSUpgrader()
-
-// GetWSUpgrader return the websocket upgrader for use with vchamber
-func GetWSUpgrader() *websocket.Upgrader {
+// GetWSUpgrader return the websocket upgrader for use with vchamber, origins
+// are checked against policy and a nil policy allows all origins
+func GetWSUpgrader(policy *OriginPolicy) *websocket.Upgrader {
 	return &websocket.Upgrader{
 		ReadBufferSize:  wsReadBufferSize,
 		WriteBufferSize: wsWriteBufferSize,
 		Subprotocols: []string{
+			WebsocketSubprotocolMagicV2MsgPack,
+			WebsocketSubprotocolMagicV2,
 			WebsocketSubprotocolMagicV1,
 		},
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		}, //disable origin check
+		CheckOrigin: policy.Check,
 	}
 }
 
 // NewServer creates a new server struct
 func NewServer() *Server {
+	assertCryptoPRNG()
 	return &Server{
-		make(map[string]*Room),
-		make(chan *Room),
-		make(chan *Room),
-		make(chan bool),
-		sync.Once{},
-		sync.RWMutex{},
+		rooms:    make(map[string]*Room),
+		enqRoom:  make(chan *roomRegistration),
+		deqRoom:  make(chan *Room),
+		closing:  make(chan bool),
+		upgrader: GetWSUpgrader(nil),
 	}
 }
 
-func (s *Server) AddRoom(r *Room) {
-	s.enqRoom <- r
+// SetOriginPolicy restricts the origins allowed to connect to server s, it
+// must be called before s starts serving
+func (s *Server) SetOriginPolicy(p *OriginPolicy) {
+	s.upgrader = GetWSUpgrader(p)
+}
+
+// SetTrustedProxies makes server s take the address of clients from the
+// X-Forwarded-For header of requests relayed by p, it must be called before s
+// starts serving
+func (s *Server) SetTrustedProxies(p *TrustedProxies) {
+	s.proxies = p
+}
+
+// AddRoom registers room r with the server and starts its manager, it fails
+// if the ID of r is already in use
+func (s *Server) AddRoom(r *Room) error {
+	reg := newRoomRegistration(r)
+	select {
+	case s.enqRoom <- reg:
+		return <-reg.result
+	case <-s.closing:
+		return errors.New(CloseReasonServerShutdown)
+	}
 }
 
+// RemoveRoom tears down room r and disconnects all its clients
 func (s *Server) RemoveRoom(r *Room) {
-	s.deqRoom <- r
+	select {
+	case s.deqRoom <- r:
+	case <-s.closing:
+	}
+}
+
+// LookupRoom returns the room with the given id, or nil if there is no such room
+func (s *Server) LookupRoom(id string) *Room {
+	if "" == id {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.rooms[id]
 }
 
-func (s *Server) joinRoom(r *Room) {
+func (s *Server) joinRoom(r *Room) error {
 	if nil != r {
+		if _, ok := s.rooms[r.ID]; ok {
+			return errors.New(ErrRoomIDTaken)
+		}
 		s.rooms[r.ID] = r
 		go r.RunManager()
 		log.Printf("room %s registered", r.ID)
 	}
+	return nil
 }
 
-func (s *Server) killRoom(r *Room) {
+func (s *Server) killRoom(r *Room, reason string) {
 	if nil != r {
 		if _r, ok := s.rooms[r.ID]; ok && _r == r {
 			delete(s.rooms, r.ID)
-			close(r.closing)
-			close(r.recvQueue)
-			close(r.enqClient)
-			close(r.deqClient)
+			r.close(reason)
+			log.Printf("room %s deregistered", r.ID)
 		}
-		log.Printf("room %s deregistered", r.ID)
 	}
 }
 
@@ -143,19 +273,19 @@ func (s *Server) Run() {
 		s.mutex.Lock()
 		// kill all rooms
 		for _, r := range s.rooms {
-			s.killRoom(r)
+			s.killRoom(r, CloseReasonServerShutdown)
 		}
 		s.mutex.Unlock()
 	}()
 	for {
 		select {
-		case r := <-s.enqRoom:
+		case reg := <-s.enqRoom:
 			s.mutex.Lock()
-			s.joinRoom(r)
+			reg.result <- s.joinRoom(reg.room)
 			s.mutex.Unlock()
 		case r := <-s.deqRoom:
 			s.mutex.Lock()
-			s.killRoom(r)
+			s.killRoom(r, CloseReasonRoomDestroyed)
 			s.mutex.Unlock()
 		case <-s.closing:
 			return
@@ -163,64 +293,230 @@ func (s *Server) Run() {
 	}
 }
 
-func (r *Room) checkPosition() {
+// close signals the room manager of r to stop, only the first reason is kept
+func (r *Room) close(reason string) {
+	r.closingGuard.Do(func() {
+		r.closeReason = reason
+		close(r.closing)
+	})
+}
+
+// exec runs f in the manager goroutine of room r and waits for it to return,
+// it returns false without running f if the room has been closed
+func (r *Room) exec(f func()) bool {
+	done := make(chan bool)
+	select {
+	case r.control <- func() {
+		f()
+		close(done)
+	}:
+	case <-r.closing:
+		return false
+	}
+	<-done
+	return true
+}
+
+// checkPosition wraps around according to the playback mode or stops
+// playback once the current item has ended, it returns true if the state
+// changed, NOT thread-safe
+func (r *Room) checkPosition() bool {
 	st := r.state
 	newPos := st.position
 	if st.status == PlaybackStatusPlaying {
 		newPos += time.Since(st.lastUpdated).Seconds() * st.speed
 	}
 	if newPos > st.duration {
+		// the next item starts now rather than when the current one ended,
+		// otherwise a late check would replay every period it missed
+		if st.status == PlaybackStatusPlaying && r.wrapAround(time.Now()) {
+			return true
+		}
 		st.position = st.duration
 		st.status = PlaybackStatusStopped
 		st.lastUpdated = time.Now()
+		r.bumpVersion()
+		return true
 	}
+	return false
 }
 
-func (r *Room) UpdateState(p *PlaybackStateUpdateMessage, d time.Duration) {
-	r.state.source = p.State.Source
-	r.state.status = p.State.Status
-	r.state.speed = p.State.Speed
-	r.state.duration = p.State.Duration
+// maxSpeed is the fastest playback rate browsers support
+const maxSpeed = 16.0
+
+// validateState checks the numbers in a state sent by a client, MessagePack
+// can carry NaN and infinities but JSON cannot encode them for other clients
+func validateState(s *PlaybackStateMessage) error {
+	if !isFinite(s.Position, s.Speed, s.Duration) {
+		return errors.New("position, speed and duration must be finite")
+	}
+	if s.Duration < 0 || s.Duration > maxMediaDuration || math.Abs(s.Position) > maxMediaDuration {
+		return errors.New("position or duration is out of range")
+	}
+	if s.Speed < 0 || s.Speed > maxSpeed {
+		return errors.New("speed is out of range")
+	}
+	return nil
+}
 
+func (r *Room) UpdateState(p *PlaybackStateUpdateMessage, d time.Duration) {
 	newPos := p.State.Position
-	if r.state.status == PlaybackStatusPlaying {
+	if p.State.Status == PlaybackStatusPlaying {
 		newPos += (math.Max(p.RTT/2.0, 0.0) + d.Seconds()) * p.State.Speed
 	}
-	r.state.position = newPos
-	r.state.lastUpdated = time.Now()
+	r.setState(p.State, newPos, time.Now())
 }
 
-func (r *Room) GetCurrentStateMessage() *Message {
-	r.checkPosition()
+// setState sets the state of the room to s with position pos as of time at, NOT thread-safe
+func (r *Room) setState(s *PlaybackStateMessage, pos float64, at time.Time) {
+	if s.Source != r.state.source {
+		r.resetSource()
+	}
+	r.updateTracks(s.Tracks)
+	r.state.source = s.Source
+	r.state.status = s.Status
+	r.state.speed = s.Speed
+	r.state.duration = s.Duration
+	r.state.position = pos
+	r.state.lastUpdated = at
+	r.bumpVersion()
+	r.scheduleEnd()
+}
+
+// currentPosition returns the playback position of the room right now, it
+// leaves the wrap-around at the end of an item to checkPosition so that all
+// clients see it in the same broadcast, NOT thread-safe
+func (r *Room) currentPosition() float64 {
+	return r.positionAt(time.Now())
+}
+
+// positionAt returns the playback position of the room at time t, NOT thread-safe
+func (r *Room) positionAt(t time.Time) float64 {
 	st := r.state
 	newPos := st.position
 	if st.status == PlaybackStatusPlaying {
-		newPos += time.Since(st.lastUpdated).Seconds() * st.speed
+		// lastUpdated is in the future when resuming after buffering
+		newPos += math.Max(t.Sub(st.lastUpdated).Seconds(), 0.0) * st.speed
+	}
+	return math.Min(newPos, st.duration)
+}
+
+func (r *Room) GetCurrentStateMessage() *Message {
+	now := time.Now()
+	newPos := r.positionAt(now)
+	st := r.state
+	var startAt float64
+	if st.status == PlaybackStatusPlaying && st.lastUpdated.After(now) {
+		startAt = timeToSeconds(st.lastUpdated)
 	}
 	return &Message{
 		Type: MessageTypeStateBroadcast,
 		Payload: &PlaybackStateMessage{
-			Source:   st.source,
-			Status:   st.status,
-			Position: newPos,
-			Speed:    st.speed,
-			Duration: st.duration,
+			Source:        st.source,
+			Status:        st.status,
+			Position:      newPos,
+			ServerTime:    timeToSeconds(now),
+			StartAt:       startAt,
+			Speed:         st.speed,
+			Duration:      st.duration,
+			Mode:          st.mode,
+			Version:       st.version,
+			UpdatedBy:     st.updatedBy,
+			UpdatedByName: st.updatedByName,
+			Queue:         r.queueSnapshot(),
+			Tracks:        st.tracks,
 		},
 	}
 }
 
+// applyUpdate applies the state update in m, attributes it to its sender and
+// broadcasts the new state, NOT thread-safe
+func (r *Room) applyUpdate(m *Message) {
+	if !r.resolveUpdate(m) {
+		r.ack(m, AckRejected, "conflict")
+		return
+	}
+	r.UpdateState(m.Payload.(*PlaybackStateUpdateMessage), time.Since(m.ReceivedAt))
+	// an immediate change overrides whatever was scheduled
+	r.cancelScheduled()
+	r.finishUpdate(m.Sender)
+	r.ack(m, AckApplied, "")
+}
+
+// finishUpdate attributes a state change to client cid and broadcasts the
+// new state, NOT thread-safe
+func (r *Room) finishUpdate(cid string) {
+	r.state.updatedBy = cid
+	r.state.updatedByName = ""
+	if c, ok := r.clients[cid]; ok {
+		r.state.updatedByName = c.name
+	}
+	r.held = false
+	// masters cannot start playback while the room waits for buffering clients
+	if !r.checkBarrier() {
+		r.BroadcastState()
+	}
+}
+
+// requiresMaster reports whether only masters may send messages of type t
+func requiresMaster(t MessageType) bool {
+	switch t {
+	case MessageTypeStateUpdate, MessageTypePromote, MessageTypeDemote, MessageTypeKick,
+		MessageTypeEnqueue, MessageTypeDequeue, MessageTypeMoveItem, MessageTypeSkip,
+		MessageTypeSetMode, MessageTypeBufferingWait, MessageTypeScheduleUpdate:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues m for client c without blocking the room manager, the message
+// is dropped if the send queue of c is full, a writer stuck on a dead
+// connection gives up after writeWait and the client leaves, NOT thread-safe
+func (r *Room) send(c *ClientConn, m *Message) {
+	select {
+	case c.sendQueue <- m:
+	default:
+		log.Printf("send queue of client %s of room %s is full, dropped message type %d", c, r.ID, m.Type)
+	}
+}
+
+// broadcastEach sends the message returned by msg to every client in room r
+// like send, msg returns nil to skip a client, NOT thread-safe
+func (r *Room) broadcastEach(msg func(c *ClientConn) *Message) {
+	for _, c := range r.clients {
+		if m := msg(c); m != nil {
+			r.send(c, m)
+		}
+	}
+}
+
+// broadcast queues m for every client in room r but except, which may be
+// nil, NOT thread-safe
+func (r *Room) broadcast(m *Message, except *ClientConn) {
+	r.broadcastEach(func(c *ClientConn) *Message {
+		if c == except {
+			return nil
+		}
+		return m
+	})
+}
+
 // BroadcastState broadcasts a room's state to all clients in the room, NOT thread-safe
 func (r *Room) BroadcastState() {
 	m := r.GetCurrentStateMessage()
-	for _, c := range r.clients {
-		c.sendQueue <- m
-	}
+	r.broadcastEach(func(c *ClientConn) *Message {
+		return r.stateMessageFor(c, m)
+	})
 }
 
+// SendState sends the room state to client cid along with the chat backlog, NOT thread-safe
 func (r *Room) SendState(cid string) {
 	m := r.GetCurrentStateMessage()
 	if c, ok := r.clients[cid]; ok {
-		c.sendQueue <- m
+		r.send(c, r.stateMessageFor(c, m))
+		r.SendScheduled(c)
+		r.SendChatHistory(c)
 	}
 }
 
@@ -229,19 +525,66 @@ func (r *Room) joinClient(c *ClientConn) {
 		r.clients[c.ID] = c
 		if c.state == clientStateMaster {
 			r.masters[c.ID] = c
+			r.masterJoined()
 		}
+		r.BroadcastPresence(PresenceJoin, c)
+	}
+}
+
+// masterJoined stops the shutdown timer once the first master is present, NOT thread-safe
+func (r *Room) masterJoined() {
+	if len(r.masters) == 1 {
+		if !r.shutdownTimer.Stop() {
+			<-r.shutdownTimer.C
+		}
+	}
+}
+
+// setRole changes the role of client c and sends it a new Hello message with
+// its authority, NOT thread-safe
+func (r *Room) setRole(c *ClientConn, s clientState) {
+	if c.state == s {
+		return
+	}
+	c.state = s
+	if s == clientStateMaster {
+		r.masters[c.ID] = c
+		r.masterJoined()
+	} else {
+		delete(r.masters, c.ID)
+		r.masterLeft()
+	}
+	log.Printf("client %s is now a %s of room %s", c, s, r.ID)
+	r.send(c, c.hello())
+	r.BroadcastPresence(PresenceRole, c)
+}
+
+// masterLeft restarts the shutdown timer once the last master is gone, NOT thread-safe
+func (r *Room) masterLeft() {
+	if len(r.masters) == 0 {
+		r.shutdownTimer.Reset(r.opts.MasterlessTimeout)
 	}
 }
 
 // killClient removes a client from room r, NOT thread-safe
 func (r *Room) killClient(c *ClientConn) {
+	r.killClientWithReason(c, websocket.CloseNormalClosure, "")
+}
+
+// killClientWithReason removes a client from room r and sends it the given
+// close code and reason before its connection drops, NOT thread-safe
+func (r *Room) killClientWithReason(c *ClientConn, code int, reason string) {
 	if nil != c {
 		if _c, ok := r.clients[c.ID]; ok && (_c == c) {
-			log.Println("removing client", c.conn.RemoteAddr(), "cid:", c.ID)
+			log.Println("removing client", c.conn.RemoteAddr(), "cid:", c)
 			delete(r.clients, c.ID)
-			delete(r.masters, c.ID)
-			close(c.closing)
-			close(c.sendQueue)
+			c.shutdown(code, reason)
+			if _, ok := r.masters[c.ID]; ok {
+				delete(r.masters, c.ID)
+				r.masterLeft()
+			}
+			r.BroadcastPresence(PresenceLeave, c)
+			r.checkBarrier()
 		}
 	}
 }
@@ -249,67 +592,149 @@ func (r *Room) killClient(c *ClientConn) {
 // RunManager manages room r
 func (r *Room) RunManager() {
 
-	shutdownTimer := time.NewTimer(defaultMasterlessTimeout)
-	updateTicker := time.NewTicker(broadcastPeriod)
+	r.shutdownTimer = time.NewTimer(r.opts.MasterlessTimeout)
+	r.endTimer = time.NewTimer(0)
+	r.scheduleEnd()
+	r.scheduleTimer = time.NewTimer(0)
+	r.scheduleTimer.Stop()
+	updateTicker := time.NewTicker(r.opts.BroadcastPeriod)
 	var bufferedUpdate *Message
-	updateCooldownTimer := time.NewTimer(updateCooldown)
+	updateCooldownTimer := time.NewTimer(r.opts.UpdateCooldown)
 	updateCooldownTimer.Stop()
 	defer func() {
-		updateTicker.Stop()
-		shutdownTimer.Stop()
-		updateCooldownTimer.Stop()
+		code := websocket.CloseNormalClosure
+		if r.closeReason == CloseReasonServerShutdown {
+			code = websocket.CloseGoingAway
+		}
 		for _, c := range r.clients {
-			r.killClient(c)
+			r.killClientWithReason(c, code, r.closeReason)
 		}
-		r.server.deqRoom <- r
+		updateTicker.Stop()
+		r.shutdownTimer.Stop()
+		r.endTimer.Stop()
+		r.scheduleTimer.Stop()
+		updateCooldownTimer.Stop()
+		r.server.RemoveRoom(r)
 	}()
 	for {
 		select {
 		case <-updateCooldownTimer.C:
 			if bufferedUpdate != nil {
-				m := bufferedUpdate
-				r.UpdateState(m.Payload.(*PlaybackStateUpdateMessage), time.Since(m.ReceivedAt))
-				r.BroadcastState()
+				r.applyUpdate(bufferedUpdate)
 			}
 			bufferedUpdate = nil
 		case m := <-r.recvQueue:
+			sender, ok := r.clients[m.Sender]
+			if !ok {
+				continue
+			}
+			if requiresMaster(m.Type) && sender.state != clientStateMaster {
+				r.reject(sender, m, ErrCodeForbidden, "only masters may send this message")
+				continue
+			}
+			var err error
 			switch m.Type {
+			case MessageTypeHello:
+				err = r.updateProfile(sender, m.Payload.(*HelloMessage))
+			case MessageTypeChat:
+				err = r.BroadcastChat(sender, m.Payload.(*ChatMessage))
+			case MessageTypeReaction:
+				err = r.BroadcastReaction(sender, m.Payload.(*ReactionMessage))
+			case MessageTypeEnqueue:
+				err = r.enqueue(sender, m.Payload.(*MediaItem))
+			case MessageTypeDequeue:
+				r.dequeue(m.Payload.(*QueueItemMessage).ID)
+			case MessageTypeMoveItem:
+				p := m.Payload.(*QueueItemMessage)
+				r.moveItem(p.ID, p.Index)
+			case MessageTypeSkip:
+				r.skip()
+			case MessageTypeSetMode:
+				err = r.setMode(sender, m.Payload.(*PlaybackModeMessage).Mode)
+			case MessageTypeTrackOverride:
+				r.setTrackOverride(sender, m.Payload.(*TrackOverrideMessage))
+			case MessageTypeScheduleUpdate:
+				err = r.scheduleUpdate(sender, m.Payload.(*ScheduledUpdateMessage))
+			case MessageTypeBuffering:
+				r.setBuffering(sender, m.Payload.(*BufferingMessage).Buffering)
+			case MessageTypeBufferingWait:
+				err = r.setBufferingWait(sender, m.Payload.(*BufferingWaitMessage))
+			case MessageTypeKick:
+				p := m.Payload.(*KickMessage)
+				r.kick(p.ClientID, p.Ban, p.Reason)
+			case MessageTypePromote, MessageTypeDemote:
+				p := m.Payload.(*RoleChangeMessage)
+				if target, ok := r.clients[p.ClientID]; ok {
+					if m.Type == MessageTypePromote {
+						r.setRole(target, clientStateMaster)
+					} else {
+						r.setRole(target, clientStateGuest)
+					}
+				}
 			case MessageTypeStateUpdate:
-				// TODO: we need to somehow handle conflicting state updates
-				// TODO: when we have duration we can then make the video stop as it ends
+				// conflicting updates are resolved by applyUpdate, see version.go
 				p := m.Payload.(*PlaybackStateUpdateMessage)
-				if time.Since(r.state.lastUpdated) > updateCooldown {
+				if p.State == nil {
+					r.reject(sender, m, ErrCodeInvalid, "state update without a state")
+					continue
+				}
+				if err := validateState(p.State); err != nil || !isFinite(p.RTT) {
+					r.reject(sender, m, ErrCodeInvalid, "state update with an invalid number")
+					continue
+				}
+				if time.Since(r.state.lastUpdated) > r.opts.UpdateCooldown {
 					// log.Printf("received state update from %s, new state %v", m.Sender, p.State)
-					r.UpdateState(p, time.Since(m.ReceivedAt))
-					r.BroadcastState()
+					r.applyUpdate(m)
 				} else {
 					// buffer the update
 					// timer has stopped
 					if bufferedUpdate == nil {
 						//start the timer
-						updateCooldownTimer.Reset(9 * updateCooldown / 10)
+						updateCooldownTimer.Reset(9 * r.opts.UpdateCooldown / 10)
+					} else {
+						r.ack(bufferedUpdate, AckRejected, "superseded")
 					}
 					bufferedUpdate = m
+					r.ack(m, AckBuffered, "")
 					log.Printf("buffered state update from %s, proposed new state %v", m.Sender, p.State)
 				}
 			}
+			if err != nil {
+				r.sendError(sender, m, ErrCodeInvalid, err.Error())
+			}
 
 		case c := <-r.enqClient:
+			if !r.redeemToken(c.token) {
+				// the token was used up or revoked while c was connecting
+				log.Println("client", c, "joined with a token that is no longer valid")
+				c.shutdown(websocket.ClosePolicyViolation, CloseReasonTokenRevoked)
+				break
+			}
 			r.joinClient(c)
 			r.SendState(c.ID)
-			if c.state == clientStateMaster && len(r.masters) == 1 {
-				if !shutdownTimer.Stop() {
-					<-shutdownTimer.C
-				}
-			}
+			r.SendRoster(c.ID)
+			r.SendReactionTimeline(c)
+			r.checkBarrier()
 		case c := <-r.deqClient:
 			r.killClient(c)
-			if c.state == clientStateMaster && len(r.masters) == 0 {
-				shutdownTimer.Reset(defaultMasterlessTimeout)
-			}
+		case f := <-r.control:
+			f()
 		case <-updateTicker.C:
+			r.checkPosition()
 			r.BroadcastState()
-		case <-shutdownTimer.C:
+		case <-r.scheduleTimer.C:
+			r.applyScheduled()
+		case <-r.endTimer.C:
+			if r.checkPosition() {
+				r.BroadcastState()
+			} else {
+				// woke up early, or the state changed since the timer was armed
+				r.scheduleEnd()
+			}
+		case <-r.shutdownTimer.C:
+			r.close(CloseReasonRoomExpired)
+			return
+		case <-r.closing:
 			return
 		}
 
@@ -318,16 +743,25 @@ func (r *Room) RunManager() {
 
 // NewRoom creates a room with given id and server with no clients
 func NewRoom(id string, server *Server, mKey string, gKey string) *Room {
+	return NewRoomWithOptions(id, server, mKey, gKey, DefaultRoomOptions())
+}
+
+// NewRoomWithOptions creates a room with given id, server and options with no clients
+func NewRoomWithOptions(id string, server *Server, mKey string, gKey string, opts RoomOptions) *Room {
 	return &Room{
-		ID:        id,
-		clients:   make(map[string]*ClientConn),
-		masters:   make(map[string]*ClientConn),
-		recvQueue: make(chan *Message, roomMessageQueueSize),
-		enqClient: make(chan *ClientConn),
-		deqClient: make(chan *ClientConn),
-		closing:   make(chan bool),
-		masterKey: mKey,
-		guestKey:  gKey,
+		ID:         id,
+		clients:    make(map[string]*ClientConn),
+		masters:    make(map[string]*ClientConn),
+		recvQueue:  make(chan *Message, roomMessageQueueSize),
+		enqClient:  make(chan *ClientConn),
+		deqClient:  make(chan *ClientConn),
+		control:    make(chan func()),
+		closing:    make(chan bool),
+		tokens:     newBuiltinTokens(mKey, gKey),
+		bans:       make(map[string]bool),
+		signEpochs: make(map[string]uint64),
+		chat:       newChatRing(chatHistorySize),
+		reactions:  make(reactionTimeline),
 		state: &PlaybackState{
 			source:      "",
 			status:      PlaybackStatusStopped,
@@ -335,12 +769,14 @@ func NewRoom(id string, server *Server, mKey string, gKey string) *Room {
 			speed:       1.0,
 			lastUpdated: time.Now(),
 		},
-		server: server,
+		opts:      opts,
+		server:    server,
+		createdAt: time.Now(),
 	}
 }
 
-// NewRoomWithRandomKeys is /script>a helper function to create a new room with random keys
-func NewRoomWithRandomKeys(id string, server *Server) (*Room, string, string, error) {
+// NewRoomWithRandomKeys is a helper function to create a new room with random keys
+func NewRoomWithRandomKeys(id string, server *Server, opts RoomOptions) (*Room, string, string, error) {
 	mKey, e1 := GenerateKey(keyLength)
 	gKey, e2 := GenerateKey(keyLength)
 	if e1 != nil {
@@ -349,21 +785,68 @@ func NewRoomWithRandomKeys(id string, server *Server) (*Room, string, string, er
 	if e2 != nil {
 		return nil, "", "", e2
 	}
-	return NewRoom(id, server, mKey, gKey), mKey, gKey, nil
+	return NewRoomWithOptions(id, server, mKey, gKey, opts), mKey, gKey, nil
 }
 
-// CheckMasterKey verifies key with the room's master key
-func (r *Room) CheckMasterKey(key string) bool {
-	return key == r.masterKey
+// forward passes m on to the room manager, it returns false if the room has
+// been closed
+func (c *ClientConn) forward(m *Message) bool {
+	select {
+	case c.room.recvQueue <- m:
+		return true
+	case <-c.room.closing:
+		return false
+	}
 }
 
-// CheckGuestKey verifies key with the room's guest key
-func (r *Room) CheckGuestKey(key string) bool {
-	return key == r.guestKey
+// hello returns the Hello message telling c its identity and authority,
+// NOT thread-safe
+func (c *ClientConn) hello() *Message {
+	p := &HelloMessage{
+		ClientType: c.state.String(),
+		ClientID:   c.ID,
+		Name:       optionalString(c.name),
+		Avatar:     optionalString(c.avatar),
+	}
+	if c.protocol == ProtocolV2 {
+		p.Protocol = ProtocolV2
+		p.Capabilities = ServerCapabilities
+	}
+	return &Message{
+		Type:    MessageTypeHello,
+		Payload: p,
+	}
+}
+
+// reply queues m to be sent to c from one of the client goroutines, it
+// returns false if c is closing
+func (c *ClientConn) reply(m *Message) bool {
+	select {
+	case c.sendQueue <- m:
+		return true
+	case <-c.closing:
+		return false
+	}
+}
+
+// shutdown closes c with the given close code and reason, it must only be
+// called once per client
+func (c *ClientConn) shutdown(code int, reason string) {
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.closing)
+}
+
+// leave notifies the room manager that c is gone
+func (c *ClientConn) leave() {
+	select {
+	case c.room.deqClient <- c:
+	case <-c.room.closing:
+	}
 }
 
 // NewClientConn creates a client websocket connection wrapper
-func NewClientConn(id string, room *Room, conn *websocket.Conn, state clientState) *ClientConn {
+func NewClientConn(id string, room *Room, conn *websocket.Conn, state clientState, tokenID string) *ClientConn {
 	return &ClientConn{
 		ID:        id,
 		conn:      conn,
@@ -371,6 +854,10 @@ func NewClientConn(id string, room *Room, conn *websocket.Conn, state clientStat
 		sendQueue: make(chan *Message, clientSendQueueSize),
 		closing:   make(chan bool),
 		state:     state,
+		tokenID:   tokenID,
+		reactions: newRateLimiter(reactionRate, reactionBurst),
+		chats:     newRateLimiter(chatRate, chatBurst),
+		stalls:    newRateLimiter(stallRate, stallBurst),
 		room:      room,
 	}
 }
@@ -379,7 +866,7 @@ func NewClientConn(id string, room *Room, conn *websocket.Conn, state clientStat
 func (c *ClientConn) handleWSClientRecv() {
 	defer func() {
 		close(c.recvQueue)
-		c.room.deqClient <- c
+		c.leave()
 	}()
 	// uncomment to remove client after irresponsive for heartbeatTimeOut
 	// c.conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
@@ -398,9 +885,14 @@ func (c *ClientConn) handleWSClientRecv() {
 			// uncomment to remove client after irresponsive for heartbeatTimeOut
 			// c.conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
 			var msg Message
-			err = Deserialise(m, &msg)
-			if nil != err {
+			msg.Type = messageTypeUnknown // until the envelope is decoded
+			err = DeserialiseFrom(c.format, m, &msg)
+			if err == errUnknownMessageType {
+				c.reply(errorMessage(&msg, ErrCodeUnknownType, err.Error()))
+				continue
+			} else if nil != err {
 				log.Println("Invalid message:", string(m))
+				c.reply(errorMessage(&msg, ErrCodeBadMessage, err.Error()))
 				continue
 			}
 			c.recvQueue <- &msg
@@ -412,28 +904,40 @@ func (c *ClientConn) handleWSClientRecv() {
 func (c *ClientConn) handleWSClientSend() {
 	defer func() {
 		c.conn.Close()
-		c.room.deqClient <- c
+		c.leave()
 	}()
 	for {
 		select {
-		case msg, ok := <-c.sendQueue:
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case msg := <-c.sendQueue:
 			if msg.Type == MessageTypePong {
 				// compute the service time
 				var p *PongMessage
 				p = (msg.Payload.(*PongMessage))
 				p.SvcTime = time.Since(msg.ReceivedAt).Seconds()
+				p.ServerTime = timeToSeconds(time.Now())
+			}
+			if msg.Type == MessageTypeTimeSync {
+				c.stampTimeSync(msg.Payload.(*TimeSyncMessage))
+			}
+			if !c.wants(msg) {
+				continue
+			}
+			// broadcasts are shared by every client, so each is only
+			// serialised once per wire format
+			b, err := msg.Encode(c.format)
+			if err != nil {
+				log.Printf("failed to encode message type %d for client %s: %v", msg.Type, c.ID, err)
+				continue
 			}
-			b, _ := msg.Serialise()
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.conn.WriteMessage(websocket.TextMessage, b)
+			err = c.conn.WriteMessage(c.format.FrameType(), b)
 			if err != nil {
 				return
 			}
 		case <-c.closing:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeReason))
 			return
 		}
 	}
@@ -442,7 +946,7 @@ func (c *ClientConn) handleWSClientSend() {
 // the goroutine that runs this function controls other mutable states in c
 func (c *ClientConn) handleVChamberClient() {
 	defer func() {
-		c.room.deqClient <- c
+		c.leave()
 	}()
 	for {
 		select {
@@ -459,6 +963,7 @@ func (c *ClientConn) handleVChamberClient() {
 			case MessageTypePing:
 				var p *PingMessage
 				p = m.Payload.(*PingMessage)
+				c.setLatency(p.RTT)
 
 				var pong = Message{
 					ReceivedAt: m.ReceivedAt,
@@ -467,18 +972,72 @@ func (c *ClientConn) handleVChamberClient() {
 						Timestamp: p.Timestamp,
 					},
 				}
-				c.sendQueue <- &pong
+				if !c.reply(&pong) {
+					return
+				}
 
-			case MessageTypeStateUpdate:
-				if c.state == clientStateMaster {
-					c.room.recvQueue <- m
-				} else {
-					// otherwise we silently drop it
-					log.Println("non master attempted to change room state")
+			case MessageTypeTimeSync:
+				if !c.reply(c.timeSync(m)) {
+					return
+				}
+
+			case MessageTypeChat:
+				if !c.chats.allow() {
+					if !c.reply(errorMessage(m, ErrCodeRateLimited, "too many chat messages")) {
+						return
+					}
+					break
+				}
+				if !c.forward(m) {
+					return
+				}
+
+			case MessageTypeReaction:
+				if !c.reactions.allow() {
+					if !c.reply(errorMessage(m, ErrCodeRateLimited, "too many reactions")) {
+						return
+					}
+					break
+				}
+				if !c.forward(m) {
+					return
+				}
+
+			case MessageTypeBuffering:
+				// every change pauses or resumes the room, only reports of
+				// buffering starting are limited so that a client never
+				// holds the room because its report of being ready was dropped
+				if m.Payload.(*BufferingMessage).Buffering && !c.stalls.allow() {
+					if !c.reply(errorMessage(m, ErrCodeRateLimited, "too many buffering reports")) {
+						return
+					}
+					break
+				}
+				if !c.forward(m) {
+					return
+				}
+
+			case MessageTypeHello:
+				if p := m.Payload.(*HelloMessage); c.protocol == ProtocolV2 && p.Capabilities != nil {
+					c.setCapabilities(p.Capabilities)
+				}
+				if !c.forward(m) {
+					return
+				}
+
+			case MessageTypeTrackOverride, MessageTypeStateUpdate,
+				MessageTypePromote, MessageTypeDemote, MessageTypeKick,
+				MessageTypeEnqueue, MessageTypeDequeue, MessageTypeMoveItem, MessageTypeSkip,
+				MessageTypeSetMode, MessageTypeBufferingWait, MessageTypeScheduleUpdate:
+				// the room manager checks the authority of the sender
+				if !c.forward(m) {
+					return
 				}
 
 			default:
-				// silently drop the message
+				if !c.reply(errorMessage(m, ErrCodeUnknownType, "clients may not send this message")) {
+					return
+				}
 			}
 		case <-c.closing:
 			return
@@ -491,16 +1050,7 @@ func handleWSClient(s *Server, w http.ResponseWriter, r *http.Request) {
 	// parse query string and check if roomid is valid
 	q := r.URL.Query()
 	roomid := q.Get("rid")
-	var room *Room
-
-	if "" != roomid {
-		s.mutex.RLock()
-		rm, ok := s.rooms[roomid]
-		if ok {
-			room = rm
-		}
-		s.mutex.RUnlock()
-	}
+	room := s.LookupRoom(roomid)
 
 	if nil == room {
 		log.Println("client", r.RemoteAddr, "Requested invalid room ID", roomid)
@@ -508,54 +1058,71 @@ func handleWSClient(s *Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// token check
+	// token check, a use of the token is only consumed once the client joins
 	token := q.Get("token")
-	cState := clientStateUnauthorised
-	if room.CheckMasterKey(token) {
-		cState = clientStateMaster
-	} else if room.CheckGuestKey(token) {
-		cState = clientStateGuest
-	}
+	tok := room.findToken(token)
 
-	if cState == clientStateUnauthorised {
+	if tok == nil {
 		log.Println("client", r.RemoteAddr, "supplied invalid token", token)
 		http.Error(w, ErrInvalidToken, http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	name, avatar, err := validateProfile(q.Get("name"), q.Get("avatar"))
+	if err != nil {
+		log.Println("client", r.RemoteAddr, "supplied invalid profile:", err)
+		http.Error(w, ErrInvalidProfile, http.StatusBadRequest)
+		return
+	}
+
+	addr, own := s.proxies.clientAddress(r)
+	if room.isBanned(addr, tok.ID) {
+		log.Println("banned client", addr, "attempted to join room", roomid)
+		http.Error(w, ErrBanned, http.StatusForbidden)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	if doCheckSubprotocol && conn.Subprotocol() != WebsocketSubprotocolMagicV1 {
+	format, ok := WireFormatOf(conn.Subprotocol())
+	if doCheckSubprotocol && !ok {
 		conn.WriteMessage(websocket.CloseMessage, []byte("unsupported subprotocol version"))
 		conn.Close()
 		return
 	}
 
 	cid := xid.New().String()
-	client := NewClientConn(cid, room, conn, cState)
+	cState := tok.role
+	client := NewClientConn(cid, room, conn, cState, tok.ID)
+	if own {
+		// the address of a proxy would ban all of its clients
+		client.addr = addr
+	}
+	client.token = tok
+	client.name = name
+	client.avatar = avatar
+	client.format = format
+	client.protocol = format.Protocol()
+	desc := client.String()
 
 	go client.handleVChamberClient()
 	go client.handleWSClientSend()
 	go client.handleWSClientRecv()
 
-	cType := ""
-	if cState == clientStateMaster {
-		cType = "master"
-	} else if cState == clientStateGuest {
-		cType = "guest"
-	}
+	cType := cState.String()
 	// send Hello message
-	client.sendQueue <- &Message{
-		Type: MessageTypeHello,
-		Payload: &HelloMessage{
-			ClientType: cType,
-		}}
-	room.enqClient <- client
-	log.Printf("%s client %s from %s joined room %s", cType, cid, conn.RemoteAddr(), roomid)
+	client.sendQueue <- client.hello()
+	select {
+	case room.enqClient <- client:
+	case <-room.closing:
+		client.shutdown(websocket.CloseNormalClosure, room.closeReason)
+		return
+	}
+	log.Printf("%s client %s from %s joined room %s", cType, desc, conn.RemoteAddr(), roomid)
 }
 
 // GetVChamberWSHandleFunc returns a handle function for the server